@@ -0,0 +1,107 @@
+package timestamps
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"time"
+	"unicode/utf8"
+)
+
+// Copy copies r to the writer until EOF, and returns the first error reading or writing failed with, if any; it
+// does not Close the writer. Unless partial lines are to be output after the flush interval, carriage returns are to
+// end lines or the data is copied raw, the input is split into lines right away, sparing the bookkeeping of partial
+// lines: each line is stamped with the time it was read at, and the writer flushed before waiting on more input. Lines
+// of any length are read whole, unless capped as per WithMaxLine.
+func (tsw *TimestampedWriter) Copy(r io.Reader) error {
+	if 0 < tsw.flushInterval || tsw.cr || tsw.raw {
+		_, err := io.Copy(tsw, r)
+		return err
+	}
+
+	/* lines are stamped with the time their end was read at: either by the last read, or by an earlier one with
+	the line already buffered since, but then that was the last read too */
+	tr := &timedReader{r: r, now: tsw.now}
+
+	var (
+		delimiter = tsw.delimiter
+		br        = bufio.NewReader(tr)
+		readLine  = func() ([]byte, error) { return br.ReadBytes(delimiter) }
+	)
+	if 0 < tsw.maxLine {
+		/* lines longer than the buffer come in chunks, each one output as a line of its own; a character cut in
+		half at the end of a chunk is carried over to the next one, for the chunks to remain valid UTF-8 */
+		br = bufio.NewReaderSize(tr, tsw.maxLine)
+		split := false
+		var carry, chunk []byte
+		readLine = func() ([]byte, error) {
+			for {
+				line, err := br.ReadSlice(delimiter)
+				if 0 < len(carry) {
+					chunk = append(append(chunk[:0], carry...), line...)
+					line, carry = chunk, carry[:0]
+				}
+				/* the delimiter right after a chunk ends the line it was split from, rather than an empty one */
+				joined := split && err == nil && len(line) == 1
+				split = err == bufio.ErrBufferFull
+				if split {
+					err = nil
+					n := runeBoundary(line)
+					line, carry = line[:n], append(carry, line[n:]...)
+				}
+				if !joined {
+					return line, err
+				}
+			}
+		}
+	}
+
+	for {
+		line, err := readLine()
+		if 0 < len(line) {
+			werr := tsw.WriteLine(tr.last, bytes.TrimSuffix(line, []byte{delimiter}))
+			if werr == nil && br.Buffered() == 0 {
+				/* before waiting on more input, for output not to lag behind */
+				werr = tsw.Flush()
+			}
+			if werr != nil {
+				return werr
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// timedReader is a reader keeping track of the time data last arrived at, as per the clock now.
+type timedReader struct {
+	r    io.Reader
+	now  func() time.Time
+	last time.Time
+}
+
+func (tr *timedReader) Read(p []byte) (int, error) {
+	n, err := tr.r.Read(p)
+	if 0 < n {
+		tr.last = tr.now()
+	}
+	return n, err
+}
+
+// runeBoundary returns the length of b short of the UTF-8 encoded character it ends with, if that is incomplete: where
+// to cut b for no character to be cut in half. Anything else, invalid UTF-8 included, is left alone.
+func runeBoundary(b []byte) int {
+	for i := len(b) - 1; 0 < i && len(b)-utf8.UTFMax < i; i-- {
+		if utf8.RuneStart(b[i]) {
+			if !utf8.FullRune(b[i:]) {
+				return i
+			}
+			break
+		}
+	}
+	return len(b)
+}
@@ -0,0 +1,84 @@
+package timestamps
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+// copyLines copies input through a test writer with opts, and returns the output lines without their timestamps.
+func copyLines(t *testing.T, input string, opts ...Option) []string {
+	t.Helper()
+
+	var buf bytes.Buffer
+	w := newTestWriter(&buf, opts...)
+	if err := w.Copy(strings.NewReader(input)); err != nil {
+		t.Fatalf("Copy() = %v", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close() = %v", err)
+	}
+
+	var lines []string
+	for _, line := range strings.SplitAfter(buf.String(), "\n") {
+		if line != "" {
+			lines = append(lines, strings.TrimPrefix(line, "2024/03/05 02:07:09| "))
+		}
+	}
+	return lines
+}
+
+func TestCopyLongLine(t *testing.T) {
+	const size = 3 << 20
+	long := strings.Repeat("x", size)
+
+	lines := copyLines(t, long+"\ny\n")
+	if len(lines) != 2 || lines[0] != long+"\n" || lines[1] != "y\n" {
+		t.Errorf("got %d lines; want the %d bytes line whole, then y", len(lines), size)
+	}
+
+	/* capped, the line comes in chunks, the newline ending the last one rather than making an empty line */
+	lines = copyLines(t, long+"\ny\n", WithMaxLine(1<<20))
+	if len(lines) != 4 || lines[3] != "y\n" {
+		t.Fatalf("got %d lines; want 3 chunks, then y", len(lines))
+	}
+	for i, chunk := range lines[:3] {
+		if want := strings.Repeat("x", 1<<20) + "\n"; chunk != want {
+			t.Errorf("chunk %d is %d bytes; want %d", i, len(chunk), len(want))
+		}
+	}
+}
+
+func TestCopyLongLineSmallCap(t *testing.T) {
+	/* below the least cap, the line is split at that one */
+	lines := copyLines(t, strings.Repeat("x", 40)+"\n", WithMaxLine(4))
+	want := []string{strings.Repeat("x", 16) + "\n", strings.Repeat("x", 16) + "\n", strings.Repeat("x", 8) + "\n"}
+	if strings.Join(lines, "|") != strings.Join(want, "|") {
+		t.Errorf("chunks = %q; want %q", lines, want)
+	}
+}
+
+func TestCopyLongLineUTF8(t *testing.T) {
+	tests := []struct {
+		input string
+		want  []string
+	}{
+		{"日本語のテキストです\n", []string{"日本語のテ\n", "キストです\n"}},
+		{"😀😁😂😃😄😅😆😉\n", []string{"😀😁😂😃\n", "😄😅😆😉\n"}},
+		{"a😀b😁c日本d\n", []string{"a😀b😁c日\n", "本d\n"}},
+	}
+
+	/* chunks end short of a character that would be cut in half, which starts the next chunk instead */
+	for _, tt := range tests {
+		lines := copyLines(t, tt.input, WithMaxLine(16))
+		if strings.Join(lines, "|") != strings.Join(tt.want, "|") {
+			t.Errorf("chunks of %q = %q; want %q", tt.input, lines, tt.want)
+		}
+		for _, line := range lines {
+			if !utf8.ValidString(line) {
+				t.Errorf("chunk %q is not valid UTF-8", line)
+			}
+		}
+	}
+}
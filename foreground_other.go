@@ -0,0 +1,9 @@
+//go:build !unix
+
+package timestamps
+
+import "os"
+
+func inForeground(process *os.Process) bool {
+	return false
+}
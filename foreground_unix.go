@@ -0,0 +1,31 @@
+//go:build unix
+
+package timestamps
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// inForeground tells whether the process is in the caller's process group, and that group is the foreground one of
+// the controlling terminal: signals the terminal generates, as on ^C, then reach the process directly.
+func inForeground(process *os.Process) bool {
+	pgrp, err := unix.Getpgid(0)
+	if err != nil {
+		return false
+	}
+	if pgid, err := unix.Getpgid(process.Pid); err != nil || pgid != pgrp {
+		return false
+	}
+
+	tty, err := os.Open("/dev/tty")
+	if err != nil {
+		/* no controlling terminal, no signals from it */
+		return false
+	}
+	defer tty.Close()
+
+	foreground, err := unix.IoctlGetInt(int(tty.Fd()), unix.TIOCGPGRP)
+	return err == nil && foreground == pgrp
+}
@@ -0,0 +1,217 @@
+// Package timestamps provides a writer that prepends a timestamp to each line of text written to it, along with the
+// timestamp formats it supports.
+package timestamps
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+)
+
+// TimeFormat identifies one of the predefined timestamp formats.
+type TimeFormat int
+
+// The predefined timestamp formats; CUSTOM stands for a user-supplied time layout.
+const (
+	DEFAULT TimeFormat = iota
+	ANSI
+	RFC3339
+	RFC3339Nano
+	ISO8601Basic
+	ISOWeek
+	ISOWeekTime
+	KITCHEN
+	STAMP
+	STAMPMILLI
+	RFC822
+	RFC1123
+	UNIX
+	UNIXMILLI
+	UNIXNANO
+	CUSTOM
+)
+
+// String returns the time layout of tf; it is empty for the epoch formats, which are not layout-based, and for
+// CUSTOM, the user-supplied layouts, as well as for ISOWeek, the week date alone, which no layout can express. That of
+// ISOWeekTime is the layout of the time of day following the week date.
+func (tf *TimeFormat) String() string {
+	var res string
+
+	switch *tf {
+	case DEFAULT:
+		res = "2006/01/02 03:04:05"
+	case ANSI:
+		res = time.ANSIC
+	case RFC3339:
+		res = time.RFC3339
+	case RFC3339Nano:
+		res = time.RFC3339Nano
+	case ISO8601Basic:
+		res = "20060102T150405Z0700"
+	case ISOWeekTime:
+		res = "T15:04:05Z07:00"
+	case KITCHEN:
+		res = time.Kitchen
+	case STAMP:
+		res = time.Stamp
+	case STAMPMILLI:
+		res = time.StampMilli
+	case RFC822:
+		res = time.RFC822
+	case RFC1123:
+		res = time.RFC1123
+	case ISOWeek, UNIX, UNIXMILLI, UNIXNANO, CUSTOM:
+		res = ""
+	default:
+		log.Panicf("Unexpected")
+	}
+
+	return res
+}
+
+// formatNames maps the known format names to their formats.
+var formatNames = []struct {
+	name string
+	tf   TimeFormat
+}{
+	{"default", DEFAULT},
+	{"ansi", ANSI},
+	{"rfc3339", RFC3339},
+	{"rfc3339nano", RFC3339Nano},
+	{"iso8601", RFC3339},
+	{"iso8601basic", ISO8601Basic},
+	{"isoweek", ISOWeek},
+	{"isoweektime", ISOWeekTime},
+	{"kitchen", KITCHEN},
+	{"stamp", STAMP},
+	{"stampmilli", STAMPMILLI},
+	{"rfc822", RFC822},
+	{"rfc1123", RFC1123},
+	{"unix", UNIX},
+	{"unixmilli", UNIXMILLI},
+	{"unixnano", UNIXNANO},
+}
+
+// FormatNames returns the known format names, as accepted by FromString.
+func FormatNames() []string {
+	names := make([]string, len(formatNames))
+	for i, f := range formatNames {
+		names[i] = f.name
+	}
+
+	return names
+}
+
+// FromString sets tf to the format named s, and tells whether s is a known format name at all. Names are matched
+// regardless of case, so that "RFC3339" works as well as "rfc3339"; none of them is a valid time layout anyway.
+func (tf *TimeFormat) FromString(s string) bool {
+	for _, f := range formatNames {
+		if strings.EqualFold(f.name, s) {
+			*tf = f.tf
+			return true
+		}
+	}
+
+	return false
+}
+
+// ISOWeekDate renders the ISO 8601 week date of t, as in 2024-W01-2: the ISO year, the week of the year and the day
+// of the week, Monday being 1.
+func ISOWeekDate(t time.Time) string {
+	year, week := t.ISOWeek()
+	day := int(t.Weekday())
+	if day == 0 {
+		day = 7
+	}
+
+	return fmt.Sprintf("%04d-W%02d-%d", year, week, day)
+}
+
+// layoutProbe is the instant used to validate literal time layouts. None of its fields coincide with the reference
+// time, so that formatting it always replaces at least one element of a genuine layout.
+var layoutProbe = time.Date(1999, time.November, 23, 13, 44, 33, 123456789, time.UTC)
+
+// ParseFormat maps s to a time format and its layout: s is either one of the known format names, or a literal layout
+// which is validated as per ValidateLayout.
+func ParseFormat(s string) (TimeFormat, string, error) {
+	var tf TimeFormat
+	if tf.FromString(s) {
+		return tf, tf.String(), nil
+	}
+
+	layout, err := ValidateLayout(s)
+	return CUSTOM, layout, err
+}
+
+// ValidateLayout checks that s is a usable Go time layout, by formatting a sample time with it and parsing the result
+// back, and returns it.
+func ValidateLayout(s string) (string, error) {
+	if strings.TrimSpace(s) == "" {
+		return "", errors.New("empty time format")
+	}
+	sample := layoutProbe.Format(s)
+	if sample == s {
+		return "", fmt.Errorf("illegal time format: %v (neither a format name nor a time layout)", s)
+	}
+	if _, err := time.Parse(s, sample); err != nil {
+		return "", fmt.Errorf("illegal time layout: %v (%s)", s, err)
+	}
+
+	return s, nil
+}
+
+// strftimeDirectives maps the supported strftime(3) conversions to their Go layout equivalents.
+var strftimeDirectives = map[byte]string{
+	'a': "Mon",
+	'A': "Monday",
+	'b': "Jan",
+	'B': "January",
+	'd': "02",
+	'e': "_2",
+	'f': "000000",
+	'F': "2006-01-02",
+	'H': "15",
+	'I': "03",
+	'j': "002",
+	'm': "01",
+	'M': "04",
+	'p': "PM",
+	'S': "05",
+	'T': "15:04:05",
+	'y': "06",
+	'Y': "2006",
+	'z': "-0700",
+	'Z': "MST",
+	'%': "%",
+}
+
+// StrftimeLayout translates a strftime(3) format into a Go time layout. Literal text is copied verbatim, so it must
+// not itself look like a layout element (e.g. "Jan" or "15").
+func StrftimeLayout(s string) (string, error) {
+	var layout strings.Builder
+
+	for i := 0; i < len(s); i++ {
+		if s[i] != '%' {
+			layout.WriteByte(s[i])
+			continue
+		}
+
+		i++
+		if i == len(s) {
+			return "", fmt.Errorf("illegal strftime format: %v (trailing '%%')", s)
+		}
+		directive, ok := strftimeDirectives[s[i]]
+		if !ok {
+			return "", fmt.Errorf("illegal strftime format: %v (unknown directive %%%c)", s, s[i])
+		}
+		/* Go only recognizes fractional seconds right after a decimal separator */
+		if s[i] == 'f' && (i < 2 || (s[i-2] != '.' && s[i-2] != ',')) {
+			return "", fmt.Errorf("illegal strftime format: %v (%%f must follow a '.' or ',')", s)
+		}
+		layout.WriteString(directive)
+	}
+
+	return layout.String(), nil
+}
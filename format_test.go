@@ -0,0 +1,105 @@
+package timestamps
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestFromStringIgnoresCase(t *testing.T) {
+	tests := []struct {
+		name string
+		want TimeFormat
+	}{
+		{"rfc3339", RFC3339},
+		{"RFC3339", RFC3339},
+		{"Rfc3339Nano", RFC3339Nano},
+		{"ANSI", ANSI},
+		{"Default", DEFAULT},
+		{"UnixMilli", UNIXMILLI},
+		{"UNIXNANO", UNIXNANO},
+	}
+
+	for _, tt := range tests {
+		var tf TimeFormat
+		if !tf.FromString(tt.name) || tf != tt.want {
+			t.Errorf("FromString(%q) gave %v; want %v", tt.name, tf, tt.want)
+		}
+	}
+
+	var tf TimeFormat
+	if tf.FromString("rfc-3339") {
+		t.Errorf("FromString(%q) = true; want false", "rfc-3339")
+	}
+}
+
+func TestParseFormatIgnoresCase(t *testing.T) {
+	/* a name in capitals is a name all the same, not a literal layout */
+	tf, layout, err := ParseFormat("RFC3339")
+	if err != nil || tf != RFC3339 || layout != "2006-01-02T15:04:05Z07:00" {
+		t.Errorf("ParseFormat(%q) = %v, %q, %v; want RFC3339", "RFC3339", tf, layout, err)
+	}
+}
+
+// formatted returns the timestamp a writer in the named format outputs at t, in the location of t.
+func formatted(t *testing.T, name string, at time.Time) string {
+	t.Helper()
+
+	tf, layout, err := ParseFormat(name)
+	if err != nil {
+		t.Fatalf("ParseFormat(%q) = %v", name, err)
+	}
+	var buf bytes.Buffer
+	w := NewTimestampedWriter(&buf, "stdout", WithClock(fixedClock(at)), WithLocation(at.Location()),
+		WithFormat(tf, layout), WithSeparator(""))
+	_, _ = w.Write([]byte("\n"))
+	return buf.String()
+}
+
+// knownDates are the times the formats are checked at: a Monday in the first ISO week of the following year, and a
+// Sunday in the last ISO week of the previous year, at an offset of a half hour.
+var knownDates = []time.Time{
+	time.Date(2024, time.December, 30, 8, 5, 3, 120000000, time.UTC),
+	time.Date(2021, time.January, 3, 23, 59, 59, 0, time.FixedZone("", 5*3600+1800)),
+}
+
+func TestISOFormats(t *testing.T) {
+	tests := []struct {
+		name string
+		want []string
+	}{
+		{"iso8601", []string{"2024-12-30T08:05:03Z\n", "2021-01-03T23:59:59+05:30\n"}},
+		{"iso8601basic", []string{"20241230T080503Z\n", "20210103T235959+0530\n"}},
+		{"isoweek", []string{"2025-W01-1\n", "2020-W53-7\n"}},
+		{"isoweektime", []string{"2025-W01-1T08:05:03Z\n", "2020-W53-7T23:59:59+05:30\n"}},
+	}
+
+	for _, tt := range tests {
+		for i, at := range knownDates {
+			if got := formatted(t, tt.name, at); got != tt.want[i] {
+				t.Errorf("%s at %v = %q; want %q", tt.name, at, got, tt.want[i])
+			}
+		}
+	}
+}
+
+func TestStdlibFormats(t *testing.T) {
+	tests := []struct {
+		name string
+		want []string
+	}{
+		{"kitchen", []string{"8:05AM\n", "11:59PM\n"}},
+		{"stamp", []string{"Dec 30 08:05:03\n", "Jan  3 23:59:59\n"}},
+		{"stampmilli", []string{"Dec 30 08:05:03.120\n", "Jan  3 23:59:59.000\n"}},
+		{"rfc822", []string{"30 Dec 24 08:05 UTC\n", "03 Jan 21 23:59 +0530\n"}},
+		{"rfc1123", []string{"Mon, 30 Dec 2024 08:05:03 UTC\n", "Sun, 03 Jan 2021 23:59:59 +0530\n"}},
+	}
+
+	for _, tt := range tests {
+		for i, at := range knownDates {
+			if got := formatted(t, tt.name, at); got != tt.want[i] {
+				t.Errorf("%s at %v = %q; want %q", tt.name, at, got, tt.want[i])
+			}
+		}
+	}
+}
@@ -0,0 +1,8 @@
+module github.com/mwolf76/timestamps
+
+go 1.20
+
+require (
+	github.com/creack/pty v1.1.24
+	golang.org/x/sys v0.15.0
+)
@@ -0,0 +1,56 @@
+package timestamps
+
+import (
+	"errors"
+	"io"
+	"os"
+	"syscall"
+)
+
+// pty is a pseudo-terminal the child runs on, with the slave side as its stdin, stdout and stderr. Reading from it
+// gets the child output, off the master side.
+type pty struct {
+	master *os.File
+	slave  *os.File
+}
+
+func (p *pty) Read(b []byte) (int, error) {
+	n, err := p.master.Read(b)
+	/* Linux signals the slave side being closed for good, i.e. the child and its descendants being gone, with EIO:
+	that is the regular end of the stream */
+	if errors.Is(err, syscall.EIO) {
+		err = io.EOF
+	}
+	return n, err
+}
+
+// Close releases the master side, the slave side is closed as soon as the child has started.
+func (p *pty) Close() error {
+	return p.master.Close()
+}
+
+// connect hands the terminal over to the child once it has started: the slave side is released, keystrokes read from
+// tty are relayed to the child and its window size follows that of tty. The returned function gives the terminal back,
+// restoring its previous state.
+func (p *pty) connect(tty *os.File) func() {
+	_ = p.slave.Close()
+
+	stopResizing := func() {}
+	restore := func() {}
+	if IsTerminal(tty) {
+		stopResizing = propagateWinsize(p.master, tty)
+		if r, err := makeRaw(tty); err == nil {
+			restore = r
+		}
+	}
+
+	/* never waited for: reading tty blocks until it has input, even after the child has exited */
+	go func() {
+		_, _ = io.Copy(p.master, tty)
+	}()
+
+	return func() {
+		stopResizing()
+		restore()
+	}
+}
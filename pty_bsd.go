@@ -0,0 +1,11 @@
+//go:build darwin || freebsd || netbsd || openbsd || dragonfly
+
+package timestamps
+
+import "golang.org/x/sys/unix"
+
+/* the ioctl requests getting and setting the termios of a terminal */
+const (
+	getTermios = unix.TIOCGETA
+	setTermios = unix.TIOCSETA
+)
@@ -0,0 +1,9 @@
+package timestamps
+
+import "golang.org/x/sys/unix"
+
+/* the ioctl requests getting and setting the termios of a terminal */
+const (
+	getTermios = unix.TCGETS
+	setTermios = unix.TCSETS
+)
@@ -0,0 +1,23 @@
+//go:build !linux && !darwin && !freebsd && !netbsd && !openbsd && !dragonfly
+
+package timestamps
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+)
+
+var errPtyUnsupported = errors.New("pseudo-terminals are not supported on this platform")
+
+func attachPty(cmd *exec.Cmd) (*pty, error) {
+	return nil, errPtyUnsupported
+}
+
+func propagateWinsize(master *os.File, tty *os.File) func() {
+	return func() {}
+}
+
+func makeRaw(tty *os.File) (func(), error) {
+	return nil, errPtyUnsupported
+}
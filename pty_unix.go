@@ -0,0 +1,94 @@
+//go:build linux || darwin || freebsd || netbsd || openbsd || dragonfly
+
+package timestamps
+
+import (
+	"os"
+	"os/exec"
+	"os/signal"
+	"syscall"
+
+	creackpty "github.com/creack/pty"
+	"golang.org/x/sys/unix"
+)
+
+// attachPty arranges for cmd to run on the slave side of a new pseudo-terminal, as the leader of a new session with
+// the pty as its controlling terminal.
+func attachPty(cmd *exec.Cmd) (*pty, error) {
+	master, slave, err := creackpty.Open()
+	if err != nil {
+		return nil, err
+	}
+
+	/* no \n to \r\n translation: lines are to be timestamped, not displayed by the pty */
+	termios, err := unix.IoctlGetTermios(int(slave.Fd()), getTermios)
+	if err == nil {
+		termios.Oflag &^= unix.ONLCR
+		err = unix.IoctlSetTermios(int(slave.Fd()), setTermios, termios)
+	}
+	if err != nil {
+		_ = master.Close()
+		_ = slave.Close()
+		return nil, err
+	}
+
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = slave, slave, slave
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true, Setctty: true}
+
+	return &pty{master, slave}, nil
+}
+
+// propagateWinsize keeps the window size of the pty master in sync with that of the terminal tty, until the returned
+// function is called.
+func propagateWinsize(master *os.File, tty *os.File) func() {
+	resize := func() {
+		_ = creackpty.InheritSize(tty, master)
+	}
+	resize()
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGWINCH)
+
+	done := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-signals:
+				resize()
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	return func() {
+		signal.Stop(signals)
+		close(done)
+	}
+}
+
+// makeRaw puts the terminal tty in raw input mode, so that keystrokes reach the child's pty unprocessed; output
+// processing is left alone, for the timestamped lines to display as usual. The returned function restores the
+// previous state.
+func makeRaw(tty *os.File) (func(), error) {
+	fd := int(tty.Fd())
+	saved, err := unix.IoctlGetTermios(fd, getTermios)
+	if err != nil {
+		return nil, err
+	}
+
+	raw := *saved
+	raw.Iflag &^= unix.IGNBRK | unix.BRKINT | unix.PARMRK | unix.ISTRIP | unix.INLCR | unix.IGNCR | unix.ICRNL |
+		unix.IXON
+	raw.Lflag &^= unix.ECHO | unix.ECHONL | unix.ICANON | unix.ISIG | unix.IEXTEN
+	raw.Cc[unix.VMIN] = 1
+	raw.Cc[unix.VTIME] = 0
+	err = unix.IoctlSetTermios(fd, setTermios, &raw)
+	if err != nil {
+		return nil, err
+	}
+
+	return func() {
+		_ = unix.IoctlSetTermios(fd, setTermios, saved)
+	}, nil
+}
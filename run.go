@@ -0,0 +1,379 @@
+package timestamps
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// ExitCommandFailed is the exit status Run gives when the command could not be run at all (e.g. not found), as opposed
+// to it running and failing; as with shells.
+const ExitCommandFailed = 127
+
+// ExitTimedOut is the exit status Run gives when the command was terminated for running past its timeout, as with GNU
+// timeout.
+const ExitTimedOut = 124
+
+// RunOptions tells Run what command to run, how, and how its output gets timestamped.
+type RunOptions struct {
+	/* the command, and the arguments it is given */
+	Name string
+	Args []string
+
+	/* the working directory, if other than that of the caller, and the environment settings added to those inherited,
+	overriding them */
+	Dir string
+	Env []string
+
+	/* the input of the command; os.Stdin if nil */
+	Stdin io.Reader
+
+	/* whether stderr goes to the same pipe as stdout, for the order of lines across the two to be kept, or the command
+	runs on a pseudo-terminal, as when run interactively; either way, all of the output comes as stdout */
+	Merge bool
+	Pty   bool
+
+	/* the time the command is stopped after, if not zero, and the signal it is stopped with, SIGTERM if nil; once
+	stopped, it has KillGrace to exit before getting killed */
+	Timeout    time.Duration
+	KillSignal os.Signal
+	KillGrace  time.Duration
+
+	/* whether SIGINT, SIGTERM and SIGHUP delivered to the caller are relayed to the command: as they are, or as
+	StopSignal if not nil, followed by KillGrace before getting killed as well if GraceOnSignal is set; Interrupted, if
+	not nil, is set once a signal has been relayed */
+	ForwardSignals bool
+	StopSignal     os.Signal
+	GraceOnSignal  bool
+	Interrupted    *atomic.Bool
+
+	/* the time between the reports of the rate of lines on each stream, if any */
+	StatsInterval time.Duration
+
+	/* creates the writer of the named stream, "stdout" or "stderr", or "ts" for the lines of Run's own, which share
+	the mutex mu for lines not to interleave */
+	NewWriter func(streamName string, mu *sync.Mutex) *TimestampedWriter
+
+	/* called with the process of the command once started, before any writer is created, if not nil */
+	Started func(process *os.Process)
+
+	/* receives the verbose output of what Run does, if not nil */
+	Logf func(format string, args ...any)
+}
+
+// stream connects one of the child's output pipes to the writer timestamping it.
+type stream struct {
+	name string
+	out  *TimestampedWriter
+	in   io.ReadCloser
+}
+
+// Run runs the command, timestamping its output, and returns the exit status the caller should terminate with: that
+// of the command, unless it could not be run at all, timed out or its output could not be copied, in which case the
+// error tells what went wrong. Exiting is up to the caller, as is reporting the error.
+func Run(ctx context.Context, opts RunOptions) (status int, err error) {
+	if 0 < opts.Timeout {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, opts.Timeout)
+		defer cancel()
+	}
+	killSignal := opts.KillSignal
+	if killSignal == nil {
+		killSignal = syscall.SIGTERM
+	}
+
+	cmd := exec.CommandContext(ctx, opts.Name, opts.Args...)
+	cmd.Cancel = func() error {
+		return cmd.Process.Signal(killSignal)
+	}
+	cmd.Dir = opts.Dir
+	if 0 < len(opts.Env) {
+		/* later settings win over earlier ones, so that these override the inherited ones */
+		cmd.Env = append(os.Environ(), opts.Env...)
+	}
+
+	var streams []stream
+	var terminal *pty
+
+	if opts.Pty {
+		terminal, err = attachPty(cmd)
+		if err != nil {
+			return ExitCommandFailed, fmt.Errorf("could not allocate a pty: %w", err)
+		}
+		streams = append(streams, stream{name: "stdout", in: terminal})
+	} else {
+		/* hand over stdin itself rather than a pipe: there is no copying to wait on after the child exits */
+		cmd.Stdin = opts.Stdin
+		if cmd.Stdin == nil {
+			cmd.Stdin = os.Stdin
+		}
+
+		stdoutIn, err := cmd.StdoutPipe()
+		if err != nil {
+			return ExitCommandFailed, fmt.Errorf("could not connect to stdout pipe: %w", err)
+		}
+		streams = append(streams, stream{name: "stdout", in: stdoutIn})
+
+		if opts.Merge {
+			/* a single pipe for both, so that lines arrive in the order the child wrote them */
+			cmd.Stderr = cmd.Stdout
+		} else {
+			stderrIn, err := cmd.StderrPipe()
+			if err != nil {
+				return ExitCommandFailed, fmt.Errorf("could not connect to stderr pipe: %w", err)
+			}
+			streams = append(streams, stream{name: "stderr", in: stderrIn})
+		}
+	}
+
+	err = cmd.Start()
+	if err != nil {
+		return ExitCommandFailed, fmt.Errorf("could not start: %w", err)
+	}
+	if opts.Started != nil {
+		opts.Started(cmd.Process)
+	}
+
+	/* stdout and stderr usually end up on the same terminal, keep their lines from interleaving */
+	var mu sync.Mutex
+	for i, s := range streams {
+		streams[i].out = opts.NewWriter(s.name, &mu)
+	}
+
+	/* once stopped, the command has a grace period to exit before getting killed; it has not until its output is
+	closed, as far as can be told, processes it may have left behind included */
+	var escalation sync.Once
+	copied := make(chan struct{})
+	escalate := func() {
+		escalation.Do(func() {
+			select {
+			case <-copied:
+			case <-time.After(opts.KillGrace):
+				opts.notice(&mu, fmt.Sprintf("--- output still open %v after stopping the command, killing it ---",
+					opts.KillGrace))
+				_ = cmd.Process.Kill()
+				for _, s := range streams {
+					_ = s.in.Close()
+				}
+			}
+		})
+	}
+
+	stopForwarding := func() {}
+	if opts.ForwardSignals {
+		var relayed func()
+		if opts.GraceOnSignal {
+			relayed = escalate
+		}
+		stopForwarding = opts.forwardSignals(cmd.Process, relayed)
+	}
+	if terminal != nil {
+		defer terminal.connect(os.Stdin)()
+	}
+
+	if 0 < opts.Timeout {
+		go func() {
+			<-ctx.Done()
+			if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+				escalate()
+			}
+		}()
+	}
+
+	stopReporting := func() {}
+	if 0 < opts.StatsInterval {
+		stopReporting = opts.reportRates(&mu, streams)
+	}
+
+	/* copying comes first, Wait closes the pipes: waiting on the child before they are drained would lose the tail
+	of the output, all the more so with a command exiting right after a burst */
+	copyErr := processStreams(cmd.Process, streams...)
+	close(copied)
+	stopReporting()
+	if copyErr != nil {
+		copyErr = fmt.Errorf("could not copy output: %w", copyErr)
+	}
+
+	err = cmd.Wait()
+	stopForwarding()
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return ExitTimedOut, fmt.Errorf("command timed out after %v", opts.Timeout)
+	}
+	if err != nil {
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
+			return exitStatus(exitErr), copyErr
+		}
+		return ExitCommandFailed, fmt.Errorf("command failed: %w", err)
+	}
+	if copyErr != nil {
+		return 1, copyErr
+	}
+
+	return 0, nil
+}
+
+// notice outputs a timestamped line of Run's own, as a marker between the lines of the command. Failing to is not
+// worth failing the run over, the output of the command is what counts.
+func (opts *RunOptions) notice(mu *sync.Mutex, text string) {
+	w := opts.NewWriter("ts", mu)
+	_ = w.WriteLine(time.Now(), []byte(text))
+	_ = w.Close()
+}
+
+// logf outputs verbose output, if asked for.
+func (opts *RunOptions) logf(format string, args ...any) {
+	if opts.Logf != nil {
+		opts.Logf(format, args...)
+	}
+}
+
+// reportRates outputs a timestamped line with the rate of lines of each of the streams every StatsInterval, until
+// the returned function is called.
+func (opts *RunOptions) reportRates(mu *sync.Mutex, streams []stream) func() {
+	interval := opts.StatsInterval
+	ticker := time.NewTicker(interval)
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+
+		previous := make([]int, len(streams))
+		for {
+			select {
+			case <-ticker.C:
+				var rates []string
+				for i, s := range streams {
+					lines, _ := s.out.Stats()
+					rates = append(rates, fmt.Sprintf("%.1f lines/s on %s", float64(lines-previous[i])/interval.Seconds(),
+						s.name))
+					previous[i] = lines
+				}
+				opts.notice(mu, "--- "+strings.Join(rates, ", ")+" ---")
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	return func() {
+		ticker.Stop()
+		close(done)
+		<-stopped
+	}
+}
+
+// exitStatus maps the child's termination to a shell-style exit status: its own exit code, or 128 plus the signal
+// number if it was killed by a signal.
+func exitStatus(exitErr *exec.ExitError) int {
+	if ws, ok := exitErr.Sys().(syscall.WaitStatus); ok && ws.Signaled() {
+		return 128 + int(ws.Signal())
+	}
+	return exitErr.ExitCode()
+}
+
+// forwardSignals relays SIGINT, SIGTERM and SIGHUP delivered to the caller to the child process, until the returned
+// function is called; as they are, or as StopSignal if not nil. Once a signal is relayed, relayed is called, if not
+// nil. The child deliberately stays in the caller's process group, so that it can still read from the terminal;
+// signals generated by the terminal (e.g. ^C) reach it directly while that group is in the foreground, and relaying
+// them as they are would deliver them twice: SIGINT and SIGHUP are then taken to come from there, and only the
+// signals sent to the caller alone are relayed.
+func (opts *RunOptions) forwardSignals(process *os.Process, relayed func()) func() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+
+	done := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case sig := <-signals:
+				if opts.Interrupted != nil {
+					opts.Interrupted.Store(true)
+				}
+				if opts.StopSignal != nil {
+					sig = opts.StopSignal
+				} else if sig != syscall.SIGTERM && inForeground(process) {
+					opts.logf("not forwarding signal: %v, the command got it from the terminal", sig)
+					sig = nil
+				}
+				if sig != nil {
+					opts.logf("forwarding signal: %v", sig)
+					_ = process.Signal(sig)
+				}
+				if relayed != nil {
+					go relayed()
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	return func() {
+		signal.Stop(signals)
+		close(done)
+	}
+}
+
+// processStreams copies the child's output until all of its pipes are drained, and then flushes the final partial
+// lines. Drained means at end of file, which the child exiting does not bring about by itself: what it wrote before
+// exiting is still in the pipes, to be read all the same, and any descendants may keep writing to them. It returns the
+// first error a copy failed with, if any, other than a pipe being closed under it. Once the reader of the output goes
+// away, as with ts cmd | head, there is no point in the child carrying on: it gets a SIGPIPE, as it would when writing
+// to the closed pipe itself.
+func processStreams(process *os.Process, streams ...stream) error {
+	var wg sync.WaitGroup
+	errs := make([]error, len(streams))
+
+	wg.Add(len(streams))
+	for i, s := range streams {
+		go func(i int, s stream) {
+			defer wg.Done()
+
+			errs[i] = s.out.Copy(s.in)
+			if IsClosedPipe(errs[i]) {
+				_ = process.Signal(syscall.SIGPIPE)
+				_ = s.in.Close()
+			} else if errs[i] != nil {
+				/* keep the child from blocking on a full pipe, and thus from ever exiting */
+				_, _ = io.Copy(io.Discard, s.in)
+			}
+		}(i, s)
+	}
+	wg.Wait()
+
+	/* flushing the final partial lines may fail as well, which is only worth reporting if copying did not */
+	for i, s := range streams {
+		if err := s.out.Close(); errs[i] == nil {
+			errs[i] = err
+		}
+	}
+
+	for _, err := range errs {
+		if err != nil && !IsClosedPipe(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// IsClosedPipe tells whether err stems from a pipe closed at the other end, or under the copy; this is the regular
+// way for pipelines to end early, rather than a failure.
+func IsClosedPipe(err error) bool {
+	return errors.Is(err, syscall.EPIPE) || errors.Is(err, os.ErrClosed)
+}
+
+// IsTerminal tells whether f is attached to a terminal rather than to a pipe or a regular file.
+func IsTerminal(f *os.File) bool {
+	fi, err := f.Stat()
+	return err == nil && fi.Mode()&os.ModeCharDevice != 0
+}
@@ -0,0 +1,77 @@
+package timestamps
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+)
+
+// runOutput runs the command with Run, and returns its exit status along with the output of its streams, timestamped
+// as per the fixed clock.
+func runOutput(t *testing.T, name string, args ...string) (int, map[string]*bytes.Buffer) {
+	t.Helper()
+
+	outputs := make(map[string]*bytes.Buffer)
+	status, err := Run(context.Background(), RunOptions{
+		Name:  name,
+		Args:  args,
+		Stdin: strings.NewReader(""),
+		NewWriter: func(streamName string, mu *sync.Mutex) *TimestampedWriter {
+			buf := new(bytes.Buffer)
+			outputs[streamName] = buf
+			return newTestWriter(buf, WithMutex(mu))
+		},
+	})
+	if err != nil {
+		t.Fatalf("Run() = %d, %v", status, err)
+	}
+	return status, outputs
+}
+
+func TestRunBurstThenExit(t *testing.T) {
+	/* the command is gone as soon as it has written its output, which is in the pipes still */
+	const lines = 20000
+	status, outputs := runOutput(t, "sh", "-c", fmt.Sprintf("seq 1 %d; seq 1 %d >&2; exit 3", lines, lines))
+	if status != 3 {
+		t.Errorf("status = %d; want 3", status)
+	}
+
+	var want strings.Builder
+	for i := 1; i <= lines; i++ {
+		fmt.Fprintf(&want, "2024/03/05 02:07:09| %d\n", i)
+	}
+	for _, name := range []string{"stdout", "stderr"} {
+		if got := outputs[name].String(); got != want.String() {
+			t.Errorf("%s: %d lines; want %d", name, strings.Count(got, "\n"), lines)
+		}
+	}
+}
+
+func TestRunClosedOutput(t *testing.T) {
+	/* the reader of the output goes away, as with ts yes | head -1; the command is not to run forever */
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	go func() {
+		_, _ = r.Read(make([]byte, 1))
+		_ = r.Close()
+	}()
+
+	status, err := Run(context.Background(), RunOptions{
+		Name:  "yes",
+		Stdin: strings.NewReader(""),
+		NewWriter: func(streamName string, mu *sync.Mutex) *TimestampedWriter {
+			return NewTimestampedWriter(w, streamName, WithMutex(mu))
+		},
+	})
+	if err != nil || status != 128+int(syscall.SIGPIPE) {
+		t.Errorf("Run() = %d, %v; want %d, nil", status, err, 128+int(syscall.SIGPIPE))
+	}
+}
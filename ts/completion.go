@@ -0,0 +1,187 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/mwolf76/timestamps"
+)
+
+// completionShells are the shells -completion generates scripts for.
+var completionShells = []string{"bash", "zsh", "fish"}
+
+// completion tells what the value of a flag is completed with: one of a set of words, file names, directory names,
+// or nothing at all when there is no telling. Flags not taking a value have none.
+type completion struct {
+	words []string
+	files bool
+	dirs  bool
+}
+
+// flagCompletions tells what the values of the flags are completed with, for those where it is known; the other flags
+// taking a value get no completion.
+func flagCompletions() map[string]completion {
+	formats := completion{words: timestamps.FormatNames()}
+	files := completion{files: true}
+
+	return map[string]completion{
+		"format":          formats,
+		"stderr-format":   formats,
+		"color":           {words: []string{"auto", "always", "never"}},
+		"stderr-color":    {words: sortedKeys(colorSequences)},
+		"align":           {words: []string{"left", "right"}},
+		"blank-lines":     {words: []string{"stamp", "bare", "skip"}},
+		"syslog-priority": {words: []string{"emerg", "alert", "crit", "err", "warning", "notice", "info", "debug"}},
+		"completion":      {words: completionShells},
+		"kill-signal":     {words: sortedKeys(signalNames)},
+		"o":               files,
+		"tee":             files,
+		"config":          files,
+		"script":          files,
+		"C":               {dirs: true},
+	}
+}
+
+// flagInfo is what the completion scripts need to know about a flag.
+type flagInfo struct {
+	name       string
+	usage      string
+	takesValue bool
+	completion completion
+}
+
+// completionFlags lists the flags of ts, in lexicographical order.
+func completionFlags() []flagInfo {
+	completions := flagCompletions()
+
+	var flags []flagInfo
+	flag.VisitAll(func(f *flag.Flag) {
+		_, usage := flag.UnquoteUsage(f)
+		bf, ok := f.Value.(interface{ IsBoolFlag() bool })
+		flags = append(flags, flagInfo{
+			name:       f.Name,
+			usage:      usage,
+			takesValue: !ok || !bf.IsBoolFlag(),
+			completion: completions[f.Name],
+		})
+	})
+
+	return flags
+}
+
+// printCompletion writes the completion script for shell to w, or fails if the shell is not supported.
+func printCompletion(w io.Writer, shell string) error {
+	switch shell {
+	case "bash":
+		printBashCompletion(w, completionFlags())
+	case "zsh":
+		printZshCompletion(w, completionFlags())
+	case "fish":
+		printFishCompletion(w, completionFlags())
+	default:
+		return fmt.Errorf("illegal shell: %v (one of %s)", shell, strings.Join(completionShells, ", "))
+	}
+
+	return nil
+}
+
+// printBashCompletion writes a bash completion script, to be sourced, to w. The first word that is not a flag nor
+// the value of one is completed as a command.
+func printBashCompletion(w io.Writer, flags []flagInfo) {
+	var names, valued []string
+	for _, f := range flags {
+		names = append(names, "-"+f.name)
+		if f.takesValue {
+			valued = append(valued, "-"+f.name)
+		}
+	}
+
+	_, _ = fmt.Fprintf(w, "# bash completion for ts; source this file, e.g. from ~/.bashrc\n")
+	_, _ = fmt.Fprintf(w, "_ts() {\n")
+	_, _ = fmt.Fprintf(w, "\tlocal cur=${COMP_WORDS[COMP_CWORD]} prev=${COMP_WORDS[COMP_CWORD-1]}\n")
+	_, _ = fmt.Fprintf(w, "\tcase $prev in\n")
+	for _, f := range flags {
+		switch c := f.completion; {
+		case 0 < len(c.words):
+			_, _ = fmt.Fprintf(w, "\t-%s) COMPREPLY=($(compgen -W '%s' -- \"$cur\")); return;;\n", f.name,
+				strings.Join(c.words, " "))
+		case c.files:
+			_, _ = fmt.Fprintf(w, "\t-%s) COMPREPLY=($(compgen -f -- \"$cur\")); return;;\n", f.name)
+		case c.dirs:
+			_, _ = fmt.Fprintf(w, "\t-%s) COMPREPLY=($(compgen -d -- \"$cur\")); return;;\n", f.name)
+		}
+	}
+	_, _ = fmt.Fprintf(w, "\t%s) return;;\n", strings.Join(valued, "|"))
+	_, _ = fmt.Fprintf(w, "\tesac\n")
+	_, _ = fmt.Fprintf(w, "\tif [[ $cur == -* ]]; then\n")
+	_, _ = fmt.Fprintf(w, "\t\tCOMPREPLY=($(compgen -W '%s' -- \"$cur\"))\n", strings.Join(names, " "))
+	_, _ = fmt.Fprintf(w, "\telse\n")
+	_, _ = fmt.Fprintf(w, "\t\tCOMPREPLY=($(compgen -c -- \"$cur\"))\n")
+	_, _ = fmt.Fprintf(w, "\tfi\n")
+	_, _ = fmt.Fprintf(w, "}\n")
+	_, _ = fmt.Fprintf(w, "complete -o default -F _ts ts\n")
+}
+
+// printZshCompletion writes a zsh completion script to w, to be installed as _ts somewhere on $fpath, or sourced after
+// compinit. Everything after the flags is completed as a command line of its own.
+func printZshCompletion(w io.Writer, flags []flagInfo) {
+	escape := strings.NewReplacer("'", `'\''`, "[", `\[`, "]", `\]`, ":", `\:`)
+
+	_, _ = fmt.Fprintf(w, "#compdef ts\n")
+	_, _ = fmt.Fprintf(w, "_arguments -S \\\n")
+	for _, f := range flags {
+		spec := fmt.Sprintf("-%s[%s]", f.name, escape.Replace(f.usage))
+		if f.takesValue {
+			action := " "
+			switch c := f.completion; {
+			case 0 < len(c.words):
+				action = "(" + strings.Join(c.words, " ") + ")"
+			case c.files:
+				action = "_files"
+			case c.dirs:
+				action = "_files -/"
+			}
+			spec += ":" + f.name + ":" + action
+		}
+		_, _ = fmt.Fprintf(w, "\t'%s' \\\n", spec)
+	}
+	_, _ = fmt.Fprintf(w, "\t'*::command:_normal'\n")
+}
+
+// printFishCompletion writes a fish completion script to w, to be installed as ts.fish in
+// ~/.config/fish/completions.
+func printFishCompletion(w io.Writer, flags []flagInfo) {
+	escape := strings.NewReplacer(`\`, `\\`, "'", `\'`)
+
+	_, _ = fmt.Fprintf(w, "complete -c ts -f -a '(__fish_complete_subcommand)'\n")
+	for _, f := range flags {
+		line := fmt.Sprintf("complete -c ts -o '%s' -d '%s'", f.name, escape.Replace(f.usage))
+		if f.takesValue {
+			switch c := f.completion; {
+			case 0 < len(c.words):
+				line += " -x -a '" + strings.Join(c.words, " ") + "'"
+			case c.files:
+				line += " -r -F"
+			case c.dirs:
+				line += " -x -a '(__fish_complete_directories)'"
+			default:
+				line += " -x"
+			}
+		}
+		_, _ = fmt.Fprintln(w, line)
+	}
+}
+
+// sortedKeys returns the keys of m, in lexicographical order.
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	return keys
+}
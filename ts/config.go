@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// commandLineFlags are the names of the flags given on the command line, as opposed to those set from the defaults.
+var commandLineFlags = map[string]bool{}
+
+// envDefaults maps the environment variables providing defaults for flags to the flags they apply to.
+var envDefaults = []struct {
+	variable string
+	flag     string
+}{
+	{"TS_FORMAT", "format"},
+	{"TS_TABS", "tabs"},
+	{"TS_UTC", "utc"},
+}
+
+// applyEnvDefaults sets the flags not given on the command line from the environment variables in envDefaults.
+func applyEnvDefaults() {
+	for _, env := range envDefaults {
+		value, ok := os.LookupEnv(env.variable)
+		if !ok || value == "" || isFlagSet(env.flag) {
+			continue
+		}
+
+		err := flag.Set(env.flag, value)
+		if err != nil {
+			log.Fatalf("illegal value for %s: %v (%s)", env.variable, value, err)
+		}
+	}
+}
+
+// applyConfigDefaults sets the flags not given on the command line, nor by the environment, from the config file: the
+// one named by -config, or else ~/.config/ts/config if there is one. The file consists of name=value lines, where name
+// is that of a flag, and value may be double-quoted, e.g. to keep spaces at its ends; blank lines and lines starting
+// with '#' are ignored.
+func applyConfigDefaults() {
+	path := *configFile
+	if path == "" {
+		dir, err := os.UserConfigDir()
+		if err != nil {
+			return
+		}
+		path = filepath.Join(dir, "ts", "config")
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		/* only a config file asked for has to be there */
+		if errors.Is(err, os.ErrNotExist) && *configFile == "" {
+			return
+		}
+		log.Fatalf("ERROR: could not open config file: %s", err)
+	}
+	defer func() { _ = f.Close() }()
+
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		name, value, ok := strings.Cut(line, "=")
+		if !ok {
+			warnf("%s:%d: line will be ignored, not a name=value pair.", path, n)
+			continue
+		}
+		name, value = strings.TrimSpace(name), strings.TrimSpace(value)
+		if unquoted, err := strconv.Unquote(value); strings.HasPrefix(value, "\"") && err == nil {
+			value = unquoted
+		}
+
+		if flag.Lookup(name) == nil || name == "config" {
+			warnf("%s:%d: unknown setting %v will be ignored.", path, n, name)
+			continue
+		}
+		if isFlagSet(name) {
+			continue
+		}
+		err = flag.Set(name, value)
+		if err != nil {
+			log.Fatalf("%s:%d: illegal value for %s: %v (%s)", path, n, name, value, err)
+		}
+	}
+	if err = scanner.Err(); err != nil {
+		log.Fatalf("ERROR: could not read config file: %s", err)
+	}
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"compress/gzip"
+	"os"
+)
+
+// gzipFile is an output file compressed with gzip. Each write is flushed through to the file, a buffer of lines at a
+// time as the output is batched, so that whatever was written before a crash can still be decompressed.
+type gzipFile struct {
+	file *os.File
+	gz   *gzip.Writer
+}
+
+// newGzipFile compresses the output written to f; closing it finalizes the gzip stream, then closes f.
+func newGzipFile(f *os.File) *gzipFile {
+	return &gzipFile{
+		file: f,
+		gz:   gzip.NewWriter(f),
+	}
+}
+
+func (gf *gzipFile) Write(p []byte) (int, error) {
+	n, err := gf.gz.Write(p)
+	if err != nil {
+		return n, err
+	}
+
+	return n, gf.gz.Flush()
+}
+
+func (gf *gzipFile) Close() error {
+	err := gf.gz.Close()
+	if cerr := gf.file.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// gunzip returns the decompressed contents of the gzip file at path, all of its members included, or fails the test.
+func gunzip(t *testing.T, path string) string {
+	t.Helper()
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	r, err := gzip.NewReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestCreateOutputGzip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "out.log.gz")
+
+	f := createOutput(path)
+	_, _ = f.Write([]byte("a\n"))
+	_, _ = f.Write([]byte("b\n"))
+	if err := f.Close(); err != nil {
+		t.Fatalf("Close() = %v", err)
+	}
+	if got, want := gunzip(t, path), "a\nb\n"; got != want {
+		t.Errorf("decompressed %q; want %q", got, want)
+	}
+
+	/* appending adds a gzip member of its own, which decompresses along with the first */
+	*appendOutput = true
+	defer func() { *appendOutput = false }()
+
+	f = createOutput(path)
+	_, _ = f.Write([]byte("c\n"))
+	_ = f.Close()
+	if got, want := gunzip(t, path), "a\nb\nc\n"; got != want {
+		t.Errorf("decompressed %q after appending; want %q", got, want)
+	}
+}
+
+func TestGzipFileFlushesWrites(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "out.gz")
+
+	/* what was written before a crash, i.e. without Close, decompresses all the same */
+	f := createOutput(path)
+	_, _ = f.Write([]byte("a\n"))
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, _ := io.ReadAll(r)
+	if string(got) != "a\n" {
+		t.Errorf("decompressed %q before Close; want %q", got, "a\n")
+	}
+	_ = f.Close()
+}
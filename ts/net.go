@@ -0,0 +1,193 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"net/url"
+	"sync"
+	"time"
+)
+
+const (
+	/* how long connecting to or writing to the remote end may take, before it counts as down */
+	netTimeout = 5 * time.Second
+
+	/* how often to try connecting again while the remote end is down */
+	netRetryInterval = time.Second
+
+	/* how much output to hold on to while the remote end is down; the oldest is dropped past that */
+	netBacklogSize = 1 << 20
+)
+
+// netWriter sends the output written to it to a remote endpoint, over TCP or UDP: with UDP, each line goes as a
+// datagram of its own. Failures are not passed on to the writer, lest a network blip end the command: the output is
+// kept in a backlog of limited size instead, and sent once the connection has been reestablished. Sending, and
+// connecting again, happen in the background, for writes never to wait on the network.
+type netWriter struct {
+	network string
+	address string
+
+	mu      sync.Mutex
+	backlog []byte
+
+	/* signal the sender of more backlog, and of the writer being closed; done once the sender is finished */
+	pending chan struct{}
+	closing chan struct{}
+	done    chan struct{}
+	err     error
+}
+
+// dialNet connects to the endpoint given by rawURL, as in tcp://host:port or udp://host:port.
+func dialNet(rawURL string) (*netWriter, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "tcp" && u.Scheme != "udp" {
+		return nil, fmt.Errorf("illegal network address: %v (not tcp:// nor udp://)", rawURL)
+	}
+
+	nw := &netWriter{
+		network: u.Scheme,
+		address: u.Host,
+		pending: make(chan struct{}, 1),
+		closing: make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	conn, err := net.DialTimeout(nw.network, nw.address, netTimeout)
+	if err != nil {
+		return nil, err
+	}
+
+	go nw.run(conn)
+	return nw, nil
+}
+
+func (nw *netWriter) Write(p []byte) (int, error) {
+	nw.mu.Lock()
+	nw.backlog = append(nw.backlog, p...)
+	nw.trim()
+	nw.mu.Unlock()
+
+	select {
+	case nw.pending <- struct{}{}:
+	default:
+		/* the sender has been signalled already */
+	}
+	return len(p), nil
+}
+
+// trim drops the oldest output past netBacklogSize, in whole lines, so that what does get sent still makes sense.
+func (nw *netWriter) trim() {
+	if len(nw.backlog) <= netBacklogSize {
+		return
+	}
+
+	drop := len(nw.backlog) - netBacklogSize
+	if i := bytes.IndexByte(nw.backlog[drop:], '\n'); 0 <= i {
+		drop += i + 1
+	}
+	nw.backlog = append(nw.backlog[:0], nw.backlog[drop:]...)
+}
+
+// run sends the backlog over conn as it comes, until the writer is closed; while the connection is down, it tries
+// connecting again every netRetryInterval, and once more when closing.
+func (nw *netWriter) run(conn net.Conn) {
+	defer close(nw.done)
+
+	var nextAttempt time.Time
+	for closing := false; ; {
+		if conn == nil && (closing || !time.Now().Before(nextAttempt)) {
+			conn = nw.dial()
+			nextAttempt = time.Now().Add(netRetryInterval)
+		}
+		if conn != nil {
+			conn = nw.send(conn)
+		}
+		if closing {
+			nw.finish(conn)
+			return
+		}
+
+		var retry <-chan time.Time
+		if conn == nil {
+			retry = time.After(time.Until(nextAttempt))
+		}
+		select {
+		case <-nw.pending:
+		case <-retry:
+		case <-nw.closing:
+			closing = true
+		}
+	}
+}
+
+// dial connects to the endpoint again, and returns the connection, or nil if it is still down.
+func (nw *netWriter) dial() net.Conn {
+	conn, err := net.DialTimeout(nw.network, nw.address, netTimeout)
+	if err != nil {
+		return nil
+	}
+
+	verbosef("reconnected to %s://%s", nw.network, nw.address)
+	return conn
+}
+
+// send sends the backlog over conn until there is none left, and returns conn, or nil once the connection is lost;
+// what could not be sent goes back to the backlog.
+func (nw *netWriter) send(conn net.Conn) net.Conn {
+	for {
+		nw.mu.Lock()
+		data := nw.backlog
+		nw.backlog = nil
+		nw.mu.Unlock()
+		if len(data) == 0 {
+			return conn
+		}
+
+		for 0 < len(data) {
+			chunk := data
+			if nw.network == "udp" {
+				if i := bytes.IndexByte(chunk, '\n'); 0 <= i {
+					chunk = chunk[:i+1]
+				}
+			}
+
+			_ = conn.SetWriteDeadline(time.Now().Add(netTimeout))
+			n, err := conn.Write(chunk)
+			data = data[n:]
+			if err != nil {
+				warnf("lost connection to %s://%s: %s", nw.network, nw.address, err)
+				_ = conn.Close()
+
+				nw.mu.Lock()
+				nw.backlog = append(data, nw.backlog...)
+				nw.trim()
+				nw.mu.Unlock()
+				return nil
+			}
+		}
+	}
+}
+
+// finish reports the output that could not be sent, if any, and disconnects.
+func (nw *netWriter) finish(conn net.Conn) {
+	nw.mu.Lock()
+	defer nw.mu.Unlock()
+
+	if 0 < len(nw.backlog) {
+		warnf("%d bytes of output could not be sent to %s://%s", len(nw.backlog), nw.network, nw.address)
+	}
+	if conn != nil {
+		nw.err = conn.Close()
+	}
+}
+
+// Close makes a last attempt at sending the backlog, and disconnects.
+func (nw *netWriter) Close() error {
+	close(nw.closing)
+	<-nw.done
+
+	return nw.err
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestNetWriterTCP(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	received := make(chan string, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			received <- err.Error()
+			return
+		}
+		defer conn.Close()
+		data, _ := io.ReadAll(conn)
+		received <- string(data)
+	}()
+
+	nw, err := dialNet("tcp://" + ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _ = nw.Write([]byte("a\nb"))
+	_, _ = nw.Write([]byte("\nc\n"))
+	if err := nw.Close(); err != nil {
+		t.Fatalf("Close() = %v", err)
+	}
+
+	if got, want := <-received, "a\nb\nc\n"; got != want {
+		t.Errorf("received %q; want %q", got, want)
+	}
+}
+
+func TestNetWriterUDP(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+
+	nw, err := dialNet("udp://" + pc.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _ = nw.Write([]byte("a\nb\n"))
+	_ = nw.Close()
+
+	/* a datagram per line */
+	buf := make([]byte, 64)
+	for _, want := range []string{"a\n", "b\n"} {
+		_ = pc.SetReadDeadline(time.Now().Add(time.Second))
+		n, _, err := pc.ReadFrom(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := string(buf[:n]); got != want {
+			t.Errorf("datagram %q; want %q", got, want)
+		}
+	}
+}
+
+func TestNetWriterDown(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		conn, err := ln.Accept()
+		if err == nil {
+			_ = conn.Close()
+		}
+	}()
+
+	nw, err := dialNet("tcp://" + ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = ln.Close()
+
+	/* with the endpoint gone, writes are kept in the backlog rather than waiting on connecting again */
+	began := time.Now()
+	for i := 0; i < 1000; i++ {
+		_, _ = nw.Write([]byte("line\n"))
+	}
+	if elapsed := time.Since(began); netRetryInterval < elapsed {
+		t.Errorf("writes took %v with the endpoint down", elapsed)
+	}
+	_ = nw.Close()
+}
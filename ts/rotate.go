@@ -0,0 +1,258 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// rotatingFile is an output file that is rolled over once it has grown past a size: path is renamed to path.1, any
+// previous path.1 to path.2 and so on, keeping up to a given number of them, and a new file is started at path.
+// Rotation happens right after the line terminator bringing the file past its size, in the middle of a write of
+// several lines if need be, so that lines are never split across files.
+type rotatingFile struct {
+	path       string
+	maxSize    int64
+	keep       int
+	terminator []byte
+
+	file *os.File
+	size int64
+}
+
+// createRotatingFile creates the file at path, to be rotated past maxSize bytes keeping keep of the previous ones, once
+// a line ending with terminator is complete; if appending, an existing file is appended to, counting towards maxSize,
+// rather than truncated.
+func createRotatingFile(path string, maxSize int64, keep int, appending bool,
+	terminator string) (*rotatingFile, error) {
+	flags := os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	if appending {
+		flags = os.O_WRONLY | os.O_CREATE | os.O_APPEND
+	}
+
+	f, err := os.OpenFile(path, flags, 0666)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+
+	return &rotatingFile{
+		path:       path,
+		maxSize:    maxSize,
+		keep:       keep,
+		terminator: []byte(terminator),
+		file:       f,
+		size:       fi.Size(),
+	}, nil
+}
+
+func (rf *rotatingFile) Write(p []byte) (int, error) {
+	written := 0
+	for 0 < len(p) {
+		/* output comes in batches of lines: one bringing the file past its size is split after that line */
+		chunk := p
+		if room := rf.maxSize - rf.size; room < int64(len(p)) {
+			from := room - int64(len(rf.terminator))
+			if from < 0 {
+				from = 0
+			}
+			if i := bytes.Index(p[from:], rf.terminator); 0 <= i {
+				chunk = p[:from+int64(i+len(rf.terminator))]
+			}
+		}
+
+		n, err := rf.file.Write(chunk)
+		rf.size += int64(n)
+		written += n
+		if err != nil {
+			return written, err
+		}
+
+		if rf.maxSize <= rf.size && bytes.HasSuffix(chunk, rf.terminator) {
+			err = rf.rotate()
+			if err != nil {
+				return written, err
+			}
+		}
+		p = p[n:]
+	}
+	return written, nil
+}
+
+func (rf *rotatingFile) Close() error {
+	return rf.file.Close()
+}
+
+func (rf *rotatingFile) rotate() error {
+	err := rf.file.Close()
+	if err != nil {
+		return err
+	}
+
+	for i := rf.keep - 1; 0 < i; i-- {
+		err = os.Rename(fmt.Sprintf("%s.%d", rf.path, i), fmt.Sprintf("%s.%d", rf.path, i+1))
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	if 0 < rf.keep {
+		err = os.Rename(rf.path, rf.path+".1")
+		if err != nil {
+			return err
+		}
+	}
+
+	rf.file, err = os.Create(rf.path)
+	rf.size = 0
+	return err
+}
+
+// periodicFile is an output file that is rolled over as the wall clock crosses the boundaries of a period, aligned to
+// the clock (e.g. at the top of each hour), rather than relative to when ts started. Each period gets a file of its
+// own, named after path with the start of the period inserted before the extension: app-2024-01-02T15.log. The clock
+// is checked on each write, and the file only rolled over at the beginning of a line, so that lines are never split
+// across files.
+type periodicFile struct {
+	path       string
+	interval   time.Duration
+	terminator []byte
+
+	file      *os.File
+	end       time.Time
+	lineStart bool
+}
+
+// createPeriodicFile creates the file of the current period for path, to be rotated every interval at the beginning of
+// a line, following one ending with terminator.
+func createPeriodicFile(path string, interval time.Duration, terminator string) (*periodicFile, error) {
+	pf := &periodicFile{
+		path:       path,
+		interval:   interval,
+		terminator: []byte(terminator),
+		lineStart:  true,
+	}
+
+	err := pf.rotate(time.Now())
+	if err != nil {
+		return nil, err
+	}
+
+	return pf, nil
+}
+
+func (pf *periodicFile) Write(p []byte) (int, error) {
+	written := 0
+	now := time.Now()
+	for 0 < len(p) {
+		if pf.lineStart && !now.Before(pf.end) {
+			err := pf.rotate(now)
+			if err != nil {
+				return written, err
+			}
+		}
+
+		/* output comes in batches of lines: past the end of the period, one is split after the current line */
+		chunk := p
+		if !now.Before(pf.end) {
+			if i := bytes.Index(p, pf.terminator); 0 <= i {
+				chunk = p[:i+len(pf.terminator)]
+			}
+		}
+
+		n, err := pf.file.Write(chunk)
+		written += n
+		if 0 < n {
+			pf.lineStart = bytes.HasSuffix(chunk[:n], pf.terminator)
+		}
+		if err != nil {
+			return written, err
+		}
+		p = p[n:]
+	}
+	return written, nil
+}
+
+func (pf *periodicFile) Close() error {
+	return pf.file.Close()
+}
+
+// rotate closes the file of the previous period, if any, and opens the one of the period now falls in.
+func (pf *periodicFile) rotate(now time.Time) error {
+	if pf.file != nil {
+		err := pf.file.Close()
+		if err != nil {
+			return err
+		}
+	}
+
+	start := periodStart(now, pf.interval)
+	pf.end = start.Add(pf.interval)
+
+	/* stamp the name as finely as the interval requires */
+	layout := "2006-01-02"
+	if pf.interval < time.Minute {
+		layout = "2006-01-02T15-04-05"
+	} else if pf.interval < time.Hour {
+		layout = "2006-01-02T15-04"
+	} else if pf.interval < 24*time.Hour {
+		layout = "2006-01-02T15"
+	}
+	ext := filepath.Ext(pf.path)
+	name := strings.TrimSuffix(pf.path, ext) + "-" + start.Format(layout) + ext
+
+	var err error
+	pf.file, err = os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0666)
+	return err
+}
+
+// periodStart returns the beginning of the period of length d that t falls in. Periods up to a day long are aligned
+// to local midnight, longer ones to the zero time.
+func periodStart(t time.Time, d time.Duration) time.Time {
+	if 24*time.Hour < d {
+		return t.Truncate(d)
+	}
+
+	midnight := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+	return midnight.Add(t.Sub(midnight).Truncate(d))
+}
+
+// sizeUnits are the multipliers of the suffixes accepted by parseSize, powers of 1024.
+var sizeUnits = []struct {
+	suffix     string
+	multiplier int64
+}{
+	{"GB", 1 << 30},
+	{"MB", 1 << 20},
+	{"KB", 1 << 10},
+	{"G", 1 << 30},
+	{"M", 1 << 20},
+	{"K", 1 << 10},
+	{"B", 1},
+}
+
+// parseSize parses a size in bytes such as "10MB", with an optional K, M or G suffix (KB, MB and GB work as well).
+func parseSize(s string) (int64, error) {
+	digits, multiplier := strings.ToUpper(strings.TrimSpace(s)), int64(1)
+	for _, unit := range sizeUnits {
+		if strings.HasSuffix(digits, unit.suffix) {
+			digits, multiplier = strings.TrimSuffix(digits, unit.suffix), unit.multiplier
+			break
+		}
+	}
+
+	n, err := strconv.ParseInt(strings.TrimSpace(digits), 10, 64)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("illegal size: %v", s)
+	}
+
+	return n * multiplier, nil
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// readFile returns the contents of the file at path, or fails the test.
+func readFile(t *testing.T, path string) string {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestRotatingFileSplitsWrites(t *testing.T) {
+	tests := []struct {
+		name       string
+		terminator string
+		write      string
+		want       []string
+	}{
+		{"newlines", "\n", "aaaa\nbbbb\ncccc\ndddd\nee", []string{"ee", "cccc\ndddd\n", "aaaa\nbbbb\n"}},
+		{"NUL terminators", "\x00", "aaaa\x00bbbb\x00cc\ncc\x00dd\x00", []string{"", "cc\ncc\x00dd\x00", "aaaa\x00bbbb\x00"}},
+		{"CRLF", "\r\n", "aaa\r\nbbbb\r\ncc", []string{"cc", "aaa\r\nbbbb\r\n"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "out")
+			rf, err := createRotatingFile(path, 8, 3, false, tt.terminator)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			n, err := rf.Write([]byte(tt.write))
+			if err != nil || n != len(tt.write) {
+				t.Fatalf("Write() = %d, %v; want %d, nil", n, err, len(tt.write))
+			}
+			_ = rf.Close()
+
+			for i, want := range tt.want {
+				name := path
+				if 0 < i {
+					name += "." + string(rune('0'+i))
+				}
+				if got := readFile(t, name); got != want {
+					t.Errorf("%s = %q; want %q", filepath.Base(name), got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestPeriodicFileSplitsWrites(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "out.log")
+	pf, err := createPeriodicFile(path, time.Second, "\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	first := pf.file.Name()
+
+	/* a line left open, then the period ending: the rest of the line stays put, the lines after it do not */
+	_, _ = pf.Write([]byte("a\nb"))
+	time.Sleep(time.Until(pf.end))
+	_, _ = pf.Write([]byte("c\nd\n"))
+	_ = pf.Close()
+
+	second := pf.file.Name()
+	if first == second {
+		t.Fatalf("no new file after the end of the period")
+	}
+	if got, want := readFile(t, first), "a\nbc\n"; got != want {
+		t.Errorf("%s = %q; want %q", filepath.Base(first), got, want)
+	}
+	if got, want := readFile(t, second), "d\n"; got != want {
+		t.Errorf("%s = %q; want %q", filepath.Base(second), got, want)
+	}
+}
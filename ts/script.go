@@ -0,0 +1,78 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+)
+
+// readScript reads the commands of the -script file at path, one per line; blank lines and comments, the lines
+// starting with #, are skipped.
+func readScript(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+
+	var commands []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		commands = append(commands, line)
+	}
+
+	return commands, scanner.Err()
+}
+
+// runScript runs the commands one after another, each with the shell as with -c and a timestamped line marking its
+// start, as supervise does with -restart and execute otherwise. Running stops at the first command failing, unless
+// -keep-going is specified, and ends with timestamped lines telling which commands succeeded, failed or were not run.
+// The exit status is that of the first command failing, returned along with its error, or 0 if all of them succeed.
+func runScript(ctx context.Context, commands []string, cfg *config) (int, error) {
+	shell := shellPath()
+	results := make([]string, len(commands))
+	var status int
+	var err error
+	for i, command := range commands {
+		if (status != 0 && !*keepGoing) || interrupted.Load() {
+			results[i] = "not run"
+			continue
+		}
+		notice(cfg, nil, fmt.Sprintf("--- [%d/%d] %s ---", i+1, len(commands), command))
+
+		var jobStatus int
+		var jobErr error
+		if *restart {
+			jobStatus, jobErr = supervise(ctx, shell, []string{"-c", command}, cfg)
+		} else {
+			jobStatus, jobErr = execute(ctx, shell, []string{"-c", command}, cfg)
+		}
+		if jobStatus == 0 && jobErr != nil {
+			jobStatus = 1
+		}
+
+		results[i] = "ok"
+		if jobStatus != 0 {
+			results[i] = fmt.Sprintf("failed (exit status %d)", jobStatus)
+			if status == 0 {
+				status, err = jobStatus, jobErr
+			} else if jobErr != nil {
+				log.Printf("ERROR: %s", jobErr)
+			}
+		}
+	}
+
+	for i, command := range commands {
+		notice(cfg, nil, fmt.Sprintf("--- [%d/%d] %s: %s ---", i+1, len(commands), results[i], command))
+	}
+	return status, err
+}
@@ -0,0 +1,81 @@
+//go:build !windows && !plan9
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log/syslog"
+)
+
+// syslogSeverities maps the severity names accepted by -syslog-priority to their syslog counterparts.
+var syslogSeverities = map[string]syslog.Priority{
+	"emerg":   syslog.LOG_EMERG,
+	"alert":   syslog.LOG_ALERT,
+	"crit":    syslog.LOG_CRIT,
+	"err":     syslog.LOG_ERR,
+	"warning": syslog.LOG_WARNING,
+	"notice":  syslog.LOG_NOTICE,
+	"info":    syslog.LOG_INFO,
+	"debug":   syslog.LOG_DEBUG,
+}
+
+// syslogWriter sends each line written to it to the local syslog daemon as a message of its own, with the user
+// facility and a given severity.
+type syslogWriter struct {
+	writer     *syslog.Writer
+	incomplete []byte
+}
+
+// newSyslogWriter connects to the local syslog daemon, for messages tagged with tag at the named severity.
+func newSyslogWriter(severity string, tag string) (*syslogWriter, error) {
+	priority, ok := syslogSeverities[severity]
+	if !ok {
+		return nil, fmt.Errorf("illegal syslog priority: %v", severity)
+	}
+
+	w, err := syslog.New(priority|syslog.LOG_USER, tag)
+	if err != nil {
+		return nil, err
+	}
+
+	return &syslogWriter{writer: w}, nil
+}
+
+func (sw *syslogWriter) Write(p []byte) (int, error) {
+	rest := p
+	for {
+		i := bytes.IndexByte(rest, '\n')
+		if i < 0 {
+			break
+		}
+
+		line := rest[:i]
+		if 0 < len(sw.incomplete) {
+			line = append(sw.incomplete, line...)
+			sw.incomplete = sw.incomplete[:0]
+		}
+		rest = rest[i+1:]
+
+		_, err := sw.writer.Write(line)
+		if err != nil {
+			return 0, err
+		}
+	}
+	sw.incomplete = append(sw.incomplete, rest...)
+
+	return len(p), nil
+}
+
+// Close sends the final partial line, if any, and disconnects from the syslog daemon.
+func (sw *syslogWriter) Close() error {
+	if 0 < len(sw.incomplete) {
+		_, err := sw.writer.Write(sw.incomplete)
+		if err != nil {
+			_ = sw.writer.Close()
+			return err
+		}
+	}
+
+	return sw.writer.Close()
+}
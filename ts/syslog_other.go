@@ -0,0 +1,14 @@
+//go:build windows || plan9
+
+package main
+
+import (
+	"errors"
+	"io"
+)
+
+var errSyslogUnsupported = errors.New("syslog is not supported on this platform")
+
+func newSyslogWriter(severity string, tag string) (io.WriteCloser, error) {
+	return nil, errSyslogUnsupported
+}
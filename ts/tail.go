@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"sync"
+)
+
+// tailBuffer keeps the last lines of the timestamped output in memory, as per -tail, rather than having them go
+// through: they are only output once the command is done, which is the point, but defeats watching them live. The
+// lines written to all destinations are kept in a single ring, so that they come out in the order they came in.
+type tailBuffer struct {
+	mu         sync.Mutex
+	terminator []byte
+
+	lines   []tailLine
+	next    int
+	partial map[io.Writer][]byte
+}
+
+// tailLine is a line kept by a tailBuffer, along with the destination it goes to.
+type tailLine struct {
+	dst  io.Writer
+	data []byte
+}
+
+// tailWriter is the writer of a tailBuffer for one destination.
+type tailWriter struct {
+	tb  *tailBuffer
+	dst io.Writer
+}
+
+// newTailBuffer creates a buffer keeping up to size lines, ending with terminator: that of the records the writers
+// output, rather than that of the lines they read.
+func newTailBuffer(size int, terminator string) *tailBuffer {
+	return &tailBuffer{
+		terminator: []byte(terminator),
+		lines:      make([]tailLine, 0, size),
+		partial:    make(map[io.Writer][]byte),
+	}
+}
+
+// writer returns a writer keeping the lines written to it in the buffer, for them to go to dst in the end.
+func (tb *tailBuffer) writer(dst io.Writer) io.Writer {
+	return &tailWriter{tb: tb, dst: dst}
+}
+
+func (tw *tailWriter) Write(p []byte) (int, error) {
+	tb := tw.tb
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+
+	data := append(tb.partial[tw.dst], p...)
+	for {
+		i := bytes.Index(data, tb.terminator)
+		if i < 0 {
+			break
+		}
+		end := i + len(tb.terminator)
+		tb.keep(tailLine{dst: tw.dst, data: data[:end]})
+		data = data[end:]
+	}
+	tb.partial[tw.dst] = append([]byte(nil), data...)
+
+	return len(p), nil
+}
+
+// keep adds the line to the ring, in place of the oldest one once full.
+func (tb *tailBuffer) keep(line tailLine) {
+	line.data = append([]byte(nil), line.data...)
+	if len(tb.lines) < cap(tb.lines) {
+		tb.lines = append(tb.lines, line)
+		return
+	}
+
+	tb.lines[tb.next] = line
+	tb.next = (tb.next + 1) % len(tb.lines)
+}
+
+// flush outputs the lines kept, oldest first, followed by any final partial lines, and returns the first error
+// writing them failed with.
+func (tb *tailBuffer) flush() error {
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+
+	var firstErr error
+	write := func(dst io.Writer, data []byte) {
+		if _, err := dst.Write(data); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	for i := range tb.lines {
+		line := tb.lines[(tb.next+i)%len(tb.lines)]
+		write(line.dst, line.data)
+	}
+	for dst, data := range tb.partial {
+		if 0 < len(data) {
+			write(dst, data)
+		}
+	}
+
+	tb.lines, tb.next = tb.lines[:0], 0
+	tb.partial = make(map[io.Writer][]byte)
+	return firstErr
+}
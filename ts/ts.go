@@ -1,239 +1,1491 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
+	"context"
 	"flag"
 	"fmt"
 	"io"
 	"log"
 	"os"
 	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
+
+	"github.com/mwolf76/timestamps"
 )
 
-var start = time.Now()
-var format = flag.String("format", "default", "timestamp format")
+var format = flag.String("format", "default", "timestamp format, either a format name or a Go time layout")
+var lineBuffered = flag.Bool("line-buffered", false, "flush after each line, not per burst; the default on terminals")
+var flushInterval = flag.Duration("flush-interval", 0, "output partial lines after this long without new data (e.g. 500ms)")
+var color = flag.String("color", "auto", "colorize timestamps: auto (on a terminal, or per FORCE_COLOR), always or never")
+var stderrFormat = flag.String("stderr-format", "", "timestamp format of stderr lines, if other than -format")
+var stderrColor = flag.String("stderr-color", "", "stderr timestamp color: red, green, yellow, blue, magenta, cyan or dim")
+var raw = flag.Bool("raw", false, "copy the output through untouched, as for binary data: no timestamps, no lines")
+var quote = flag.Bool("quote", false, "double-quote messages, escaping quotes, backslashes and other specials")
+var stampStdout = flag.Bool("stamp-stdout", true, "timestamp stdout lines; with =false, they go through as they are")
+var stampStderr = flag.Bool("stamp-stderr", true, "timestamp stderr lines; with =false, they go through as they are")
+var label = flag.Bool("label", false, "tag each line with the stream it comes from, [out] or [err]")
+var usePty = flag.Bool("pty", false, "run the command on a pseudo-terminal, for it to behave as when run interactively")
+var merge = flag.Bool("merge", false, "merge stderr into stdout, preserving the order of lines across the two")
+var maxLine = flag.Int("max-line", 0, "split lines longer than this many bytes (at least 16), to cap memory use")
+var nul = flag.Bool("0", false, "take lines to be delimited by NUL rather than newline, as with find -print0")
+var nulNewline = flag.Bool("0-newline", false, "with -0, terminate the timestamped lines with newlines rather than NUL")
+var cr = flag.Bool("cr", false, "treat carriage returns as line endings, for each progress bar update to get timestamped")
+var crlf = flag.Bool("crlf", false, "end the timestamped lines with CRLF rather than newline, for Windows tools")
+var keepCR = flag.Bool("keep-cr", false, "keep the carriage return of CRLF line endings, rather than dropping it")
+var output = flag.String("o", "", "write the timestamped output to this file, rather than to stdout and stderr")
+var rotateSize = flag.String("rotate-size", "", "rotate the -o file once it grows past this size (e.g. 10MB)")
+var rotateKeep = flag.Int("rotate-keep", 5, "number of rotated -o files to keep, as FILE.1, FILE.2 and so on")
+var rotateInterval = flag.Duration("rotate-interval", 0, "start a new, time-named -o file every interval (e.g. 1h)")
+var useSyslog = flag.Bool("syslog", false, "send the timestamped output to syslog, rather than to stdout and stderr")
+var syslogPriority = flag.String("syslog-priority", "", "syslog severity of all lines (e.g. notice), rather than info for stdout, err for stderr")
+var netAddress = flag.String("net", "", "send the timestamped output to this endpoint, tcp://host:port or udp://host:port")
+var appendOutput = flag.Bool("append", false, "append to the -o and -tee files, rather than truncating them")
+var tail = flag.Int("tail", 0, "keep only the last this many lines, output once done rather than as they come")
+var tee = flag.String("tee", "", "write the timestamped output to this file as well")
+var jsonOutput = flag.Bool("json", false, "output each line as a JSON object, with ts, stream and message fields")
+var jsonArray = flag.Bool("json-array", false, "output the lines as objects of a JSON array, complete once ts exits")
+var logfmt = flag.Bool("logfmt", false, "output each line as logfmt key=value pairs, with ts, stream and msg keys")
+var jsonKeys = flag.String("json-keys", "", "keys and order of -json and -logfmt fields, as in time=ts,message=msg")
+var csvOutput = flag.Bool("csv", false, "output each line as a CSV record, with timestamp, stream and message columns")
+var listFormats = flag.Bool("list-formats", false, "list the format names, with an example of each, and exit")
+var completionShell = flag.String("completion", "", "print the completion script of this shell, bash, zsh or fish, and exit")
+var showVersion = flag.Bool("version", false, "print version information and exit")
+var configFile = flag.String("config", "", "read flag defaults from this file, rather than ~/.config/ts/config")
+var timeout = flag.Duration("timeout", 0, "terminate the command if still running after this long (e.g. 30s)")
+var killGrace = flag.Duration("kill-grace", 5*time.Second, "time to exit after -kill-signal, before getting SIGKILL")
+var killSignal = flag.String("kill-signal", "TERM", "signal to stop the command with, on -timeout or a signal to ts")
+var restart = flag.Bool("restart", false, "run the command again whenever it exits with a nonzero status")
+var restartMax = flag.Int("restart-max", 0, "give up after restarting the command this many times (0 means never)")
+var restartDelay = flag.Duration("restart-delay", time.Second, "wait this long before the first restart, doubling later on")
+var shellCommand = flag.String("c", "", "run this command string with $SHELL -c (or /bin/sh); arguments become $0, $1...")
+var script = flag.String("script", "", "run the commands in this file one after another, one per line, as with -c")
+var keepGoing = flag.Bool("keep-going", false, "with -script, run the remaining commands after one fails, as make -k")
+var dryRun = flag.Bool("dry-run", false, "print the command, directory and environment it would run with, and exit")
+var banner = flag.Bool("banner", false, "output the command line first, as a timestamped line like \"$ make -j4\"")
+var statsInterval = flag.Duration("stats-interval", 0, "report the rate of lines on each stream every interval (e.g. 10s)")
+var summary = flag.Bool("summary", false, "report the run time, line counts, slowest gap and exit status on exit")
+var env envList
+var dir = flag.String("C", "", "run the command in this directory")
 var verbose = flag.Bool("verbose", false, "verbose output")
+var quiet = flag.Bool("quiet", false, "do not output warnings nor the -verbose output, only errors")
+var match = flag.String("match", "", "timestamp only the lines matching this regular expression, leaving others alone")
+var grep = flag.String("grep", "", "output only the lines matching this regular expression, dropping the others")
+var blankLines = flag.String("blank-lines", "stamp", "blank lines: stamp them, output them bare, or skip them")
+var dedup = flag.Bool("dedup", false, "collapse runs of identical lines into one, followed by their count (x12)")
+var grepInvert = flag.Bool("grep-invert", false, "with -grep, output only the lines not matching it instead")
+var seq = flag.Bool("seq", false, "number the lines before their timestamps, in output order across streams")
+var seqWidth = flag.Int("seq-width", 6, "number of digits to zero-pad the -seq numbers to")
+var seqPerStream = flag.Bool("seq-per-stream", false, "with -seq, number the lines of stdout and stderr separately")
+var prefix = flag.String("prefix", "", "text to output before the timestamp on every line (e.g. \"[api] \")")
+var prefixTemplate = flag.String("prefix-template", "", "like -prefix, with {host}, {pid} and {env:NAME} filled in")
+var width = flag.Int("width", 0, "pad timestamps to this many characters, for the separators to line up")
+var align = flag.String("align", "left", "alignment of timestamps padded as per -width: left or right")
 var tabs = flag.Bool("tabs", false, "use tabs rather than spaces after the timestamp")
+var sep = flag.String("sep", "", "separator after the timestamp, overriding -tabs; may be empty (default \"| \")")
 var utc = flag.Bool("utc", false, "use utc timestamps instead of localtime ones.")
+var tz = flag.String("tz", "", "use timestamps in this IANA time zone (e.g. Europe/Rome) instead of localtime ones.")
+var strftime = flag.Bool("strftime", false, "interpret -format as a strftime(3) format; implied when it contains a '%'")
+var bothZones = flag.Bool("both-zones", false, "also show the UTC time after the local one (vice versa with -utc)")
+var utcOffset = flag.String("utc-offset", "", "use timestamps at this UTC offset (e.g. +05:30), that needs no tzdata")
 var millis = flag.Bool("millis", false, "calculate timestamps in milliseconds since program start.")
+var human = flag.Bool("human", false, "show the time elapsed since program start in a humanized form, as 1h02m03s")
+var millisWidth = flag.Int("millis-width", 0, "width of the -millis, -micros or -nanos column, if other than 12 or 15")
+var millisPrecision = flag.Int("millis-precision", 3, "number of decimals of the -millis or -micros times, from 0 to 9")
+var micros = flag.Bool("micros", false, "calculate timestamps in microseconds since program start")
+var nanos = flag.Bool("nanos", false, "calculate timestamps in nanoseconds since program start")
+var startNow = flag.Bool("start-now", false, "count elapsed times from the start of ts, rather than from the command's")
+var precision = flag.Int("precision", 0, "end timestamps with fractions of a second, of this many digits (up to 9)")
+var sinceEpoch = flag.Bool("since-epoch", false, "show seconds since start, or -relative-to, to -precision digits")
+var dual = flag.Bool("dual", false, "also show the time elapsed since program start, after the time (as in +1.500s)")
+var relativeTo = flag.String("relative-to", "", "show the time relative to this RFC 3339 time, in seconds (as in +1.500s)")
+var elapsed = flag.Bool("elapsed", false, "show the time elapsed since program start, as HH:MM:SS.mmm")
+var delta = flag.Bool("delta", false, "show the time elapsed since the previous line, as HH:MM:SS.mmm")
+var slow = flag.Duration("slow", 0, "highlight lines coming more than this long after the previous one (e.g. 1s)")
 
-type TimeFormat int
+// sinceStartUnits maps the flags of the modes showing the time since start to their units.
+var sinceStartUnits = map[string]time.Duration{
+	"millis": time.Millisecond,
+	"micros": time.Microsecond,
+	"nanos":  time.Nanosecond,
+}
 
-const (
-	DEFAULT TimeFormat = iota
-	ANSI
-	RFC3339
-	RFC3339Nano
-)
+// version is the version of ts, as set at build time with -ldflags "-X main.version=...".
+var version = "dev"
 
-func (tf *TimeFormat) String() string {
-	var res string
-
-	switch *tf {
-	case DEFAULT:
-		res = "2006/01/02 03:04:05"
-	case ANSI:
-		res = time.ANSIC
-	case RFC3339:
-		res = time.RFC3339
-	case RFC3339Nano:
-		res = time.RFC3339Nano
-	default:
-		log.Panicf("Unexpected")
+// envList collects the NAME=value settings of repeated -env flags.
+type envList []string
+
+func (e *envList) String() string {
+	return strings.Join(*e, " ")
+}
+
+func (e *envList) Set(value string) error {
+	if name, _, ok := strings.Cut(value, "="); !ok || name == "" {
+		return fmt.Errorf("not a NAME=value setting: %v", value)
 	}
 
-	return res
+	*e = append(*e, value)
+	return nil
 }
 
-func (tf *TimeFormat) fromString(s *string) bool {
-	res := true
+// outputBufferSize is the size of the buffers batching output into fewer writes.
+const outputBufferSize = 64 * 1024
 
-	switch *s {
-	case "default":
-		*tf = DEFAULT
-	case "ansi":
-		*tf = ANSI
-	case "rfc3339":
-		*tf = RFC3339
-	case "rfc3339nano":
-		*tf = RFC3339Nano
-	default:
-		res = false
+// maxRestartDelay caps the delay before restarting a failed command with -restart.
+const maxRestartDelay = time.Minute
+
+// colorSequences are the SGR sequences of the colors accepted by -stderr-color.
+var colorSequences = map[string]string{
+	"dim":     "\x1b[2m",
+	"red":     "\x1b[31m",
+	"green":   "\x1b[32m",
+	"yellow":  "\x1b[33m",
+	"blue":    "\x1b[34m",
+	"magenta": "\x1b[35m",
+	"cyan":    "\x1b[36m",
+}
+
+// style holds the settings that may differ from one stream to the other: how timestamps are formatted and colored.
+type style struct {
+	timeFormat timestamps.TimeFormat
+	layout     string
+
+	/* the SGR sequence timestamps are colored with, when colorizing; dim if empty */
+	color string
+}
+
+// config holds the settings resolved from the command line, that the writers are created with.
+type config struct {
+	/* the style of stderr, and that of the other streams */
+	stderrStyle style
+	style       style
+
+	location  *time.Location
+	separator string
+	encoding  timestamps.Encoding
+
+	/* the unit of the time since start, as per -millis, -micros or -nanos; zero otherwise */
+	sinceStart time.Duration
+
+	/* the width of the column of the time since start, as per -millis-width; negative for the default */
+	millisWidth int
+
+	/* the location of the time shown after the one proper as per -both-zones, if any */
+	secondZone *time.Location
+
+	/* the origin of the times shown as per -relative-to; zero otherwise */
+	base time.Time
+
+	/* the signal the command is stopped with on -timeout, and the one relayed in place of those ts gets, if any, as
+	per -kill-signal */
+	killSignal syscall.Signal
+	stopSignal os.Signal
+
+	/* the origin of the elapsed times, when the command was first started; zero for the start of ts, as per -start-now
+	or when timestamping stdin */
+	start time.Time
+
+	/* the lines to timestamp as per -match, and to output as per -grep, if not all of them */
+	match *regexp.Regexp
+	grep  *regexp.Regexp
+
+	/* what lines end with on input, and on output, and whether the carriage returns of CRLF line endings are kept */
+	delimiter  byte
+	terminator string
+	keepCR     bool
+
+	/* where the timestamped stdout and stderr go */
+	stdout io.Writer
+	stderr io.Writer
+
+	/* buffering of the output, one buffer per destination so that writers sharing one do not split lines */
+	buffers map[io.Writer]*bufio.Writer
+
+	/* the fields of the -json and -logfmt records as per -json-keys, if other than the usual ones */
+	fields []timestamps.Field
+
+	/* whether any lines have been output as elements of the array of -json-array, if specified */
+	jsonArray *atomic.Bool
+
+	/* the process ID of the command last started, if any, for {pid} in -prefix-template */
+	pid int
+
+	/* the numbering of lines as per -seq, one counter for all streams or, with -seq-per-stream, per stream */
+	sequences map[string]*atomic.Int64
+}
+
+// newWriter creates a writer timestamping the named stream to dst, by way of the buffer of dst; unless timestamping
+// the stream is turned off by -stamp-stdout or -stamp-stderr, in which case its lines go through as they are.
+func (c *config) newWriter(dst io.Writer, streamName string, label bool, mu *sync.Mutex) *timestamps.TimestampedWriter {
+	st := c.style
+	if streamName == "stderr" {
+		st = c.stderrStyle
+	}
+	location := c.location
+	if location == nil && *utc {
+		location = time.UTC
+	}
+
+	opts := []timestamps.Option{
+		timestamps.WithFormat(st.timeFormat, st.layout),
+		timestamps.WithLocation(location),
+		timestamps.WithPrefix(c.prefix()),
+		timestamps.WithSeparator(c.separator),
+		timestamps.WithSlow(*slow),
+		timestamps.WithDelimiters(c.delimiter, c.terminator),
+		timestamps.WithEncoding(c.encoding),
+		timestamps.WithFlushInterval(*flushInterval),
+		timestamps.WithMaxLine(*maxLine),
+		timestamps.WithMutex(mu),
+		timestamps.WithWidth(*width, *align == "right"),
+		timestamps.WithSinceStart(c.sinceStart),
+		timestamps.WithMillisWidth(c.millisWidth, *millisPrecision),
+		timestamps.WithRelativeTo(c.base),
+		timestamps.WithMatch(c.match),
+		timestamps.WithGrep(c.grep, *grepInvert),
+	}
+	if !c.start.IsZero() {
+		opts = append(opts, timestamps.WithStart(c.start))
+	}
+	if label {
+		opts = append(opts, timestamps.WithLabel())
+	}
+	if useColor(dst) {
+		opts = append(opts, timestamps.WithColors())
+	}
+	if *elapsed || *human {
+		opts = append(opts, timestamps.WithElapsed())
+	}
+	if *delta {
+		opts = append(opts, timestamps.WithDelta())
+	}
+	if *cr {
+		opts = append(opts, timestamps.WithCR())
+	}
+	if c.keepCR {
+		opts = append(opts, timestamps.WithKeepCR())
+	}
+	if *raw {
+		opts = append(opts, timestamps.WithRaw())
+	}
+	if *quote {
+		opts = append(opts, timestamps.WithQuote())
+	}
+	if isLineBuffered(dst) {
+		opts = append(opts, timestamps.WithLineBuffering())
+	}
+	if *seq {
+		opts = append(opts, timestamps.WithSequence(c.sequence(streamName), *seqWidth))
+	}
+	if 0 < *precision {
+		opts = append(opts, timestamps.WithPrecision(*precision))
+	}
+	if c.secondZone != nil {
+		opts = append(opts, timestamps.WithSecondZone(c.secondZone))
+	}
+	if c.fields != nil {
+		opts = append(opts, timestamps.WithFields(c.fields...))
+	}
+	if c.jsonArray != nil {
+		opts = append(opts, timestamps.WithJSONArray(c.jsonArray))
+	}
+	if *dual {
+		opts = append(opts, timestamps.WithDual())
+	}
+	if *dedup {
+		opts = append(opts, timestamps.WithDedup())
+	}
+	if *human {
+		opts = append(opts, timestamps.WithHuman())
+	}
+	if *sinceEpoch {
+		digits := 6
+		if isFlagSet("precision") {
+			digits = *precision
+		}
+		opts = append(opts, timestamps.WithSeconds(digits))
+	}
+	if *blankLines != "stamp" {
+		opts = append(opts, timestamps.WithBlankLines(*blankLines == "skip"))
+	}
+	if (streamName == "stderr" && !*stampStderr) || (streamName != "stderr" && !*stampStdout) {
+		opts = append(opts, timestamps.WithPassThrough())
+	}
+	if st.color != "" {
+		opts = append(opts, timestamps.WithColor(st.color))
 	}
 
-	return res
+	return timestamps.NewTimestampedWriter(c.buffer(dst), streamName, opts...)
 }
 
-// TimestampedWriter is a writer that splits text on newlines and outputs lines one at the time, prepending each
-// with a timestamp.
-type TimestampedWriter struct {
-	writer     io.Writer
-	format     string
-	utc        bool
-	millis     bool
-	tabs       bool
-	incomplete []byte
+// recordEnd returns what each line of the output ends with, as written by the writers: the terminator, unless lines
+// are output as -json, -logfmt or -csv records, which end with a newline regardless (a CRLF with -crlf).
+func (c *config) recordEnd() string {
+	if c.encoding == timestamps.TEXT || c.terminator == "\r\n" {
+		return c.terminator
+	}
+	return "\n"
 }
 
-// NewTimestampedWriter creates a new TimestampedWriter
-func NewTimestampedWriter(w io.Writer, timeFormat TimeFormat, utc *bool, millis *bool, tabs *bool) *TimestampedWriter {
-	return &TimestampedWriter{
-		writer:     w,
-		format:     timeFormat.String(),
-		utc:        *utc,
-		millis:     *millis,
-		tabs:       *tabs,
-		incomplete: make([]byte, 0),
+// prefix returns the text to output before timestamps, as per -prefix, or -prefix-template filled in for the command
+// last started or, for want of one, for ts itself.
+func (c *config) prefix() string {
+	if *prefixTemplate == "" {
+		return *prefix
+	}
+
+	pid := c.pid
+	if pid == 0 {
+		pid = os.Getpid()
 	}
+	/* validated by main already */
+	p, _ := expandPrefix(*prefixTemplate, pid)
+	return p
 }
 
-func (tsw *TimestampedWriter) Write(p []byte) (int, error) {
-	lines := bytes.Split(p, []byte("\n"))
-	last := lines[len(lines)-1]
+// sequence returns the counter numbering the lines of the named stream, shared by all streams unless -seq-per-stream
+// is specified. The numbering carries on across restarts.
+func (c *config) sequence(streamName string) *atomic.Int64 {
+	if !*seqPerStream {
+		streamName = ""
+	}
+	if c.sequences == nil {
+		c.sequences = make(map[string]*atomic.Int64)
+	}
+	if _, ok := c.sequences[streamName]; !ok {
+		c.sequences[streamName] = new(atomic.Int64)
+	}
 
-	for _, line := range lines[:len(lines)-1] {
-		var (
-			timestamp string
-			err       error
-		)
+	return c.sequences[streamName]
+}
 
-		now := time.Now()
-		if *millis {
-			timestamp = fmt.Sprintf("%12.3fms", float64(now.Sub(start).Microseconds())/1000)
-		} else {
-			if *utc {
-				now = now.UTC()
+// buffer returns the buffer output to dst goes through.
+func (c *config) buffer(dst io.Writer) *bufio.Writer {
+	if c.buffers == nil {
+		c.buffers = make(map[io.Writer]*bufio.Writer)
+	}
+	if _, ok := c.buffers[dst]; !ok {
+		c.buffers[dst] = bufio.NewWriterSize(dst, outputBufferSize)
+	}
+
+	return c.buffers[dst]
+}
+
+// execute runs the command, timestamping its output, and returns the exit status ts should terminate with: that of
+// the command, unless it could not be run at all, timed out or its output could not be copied, in which case the error
+// tells what went wrong. Exiting is up to the caller, as is reporting the error.
+func execute(ctx context.Context, name string, args []string, cfg *config) (status int, err error) {
+	/* with -merge or -pty, the child writes both stdout and stderr to the same file: which stream each line comes
+	from is lost in the process */
+	labelled := *label && !*merge && !*usePty
+
+	var streams []stream
+	opts := timestamps.RunOptions{
+		Name:           name,
+		Args:           args,
+		Dir:            *dir,
+		Env:            env,
+		Stdin:          os.Stdin,
+		Merge:          *merge,
+		Pty:            *usePty,
+		Timeout:        *timeout,
+		KillSignal:     cfg.killSignal,
+		KillGrace:      *killGrace,
+		ForwardSignals: true,
+		StopSignal:     cfg.stopSignal,
+		GraceOnSignal:  isFlagSet("kill-grace"),
+		Interrupted:    &interrupted,
+		StatsInterval:  *statsInterval,
+		Started: func(process *os.Process) {
+			cfg.pid = process.Pid
+			if cfg.start.IsZero() && !*startNow {
+				/* that of the first run, for the elapsed time to keep counting across restarts */
+				cfg.start = time.Now()
+			}
+		},
+		NewWriter: func(streamName string, mu *sync.Mutex) *timestamps.TimestampedWriter {
+			if streamName == "ts" {
+				return cfg.newWriter(cfg.stderr, streamName, false, mu)
+			}
+
+			dst := cfg.stdout
+			if streamName == "stderr" {
+				dst = cfg.stderr
 			}
-			timestamp = now.Format(tsw.format)
+			w := cfg.newWriter(dst, streamName, labelled, mu)
+			streams = append(streams, stream{name: streamName, out: w})
+			if streamName == "stdout" && *banner {
+				writeBanner(w, name, args)
+			}
+			return w
+		},
+		Logf: verbosef,
+	}
+
+	verbosef("invoking command: %v, args: %v", name, args)
+	if *summary {
+		began := time.Now()
+		defer func() {
+			printSummary(time.Since(began), streams, status)
+		}()
+	}
+	return timestamps.Run(ctx, opts)
+}
+
+// writeBanner outputs the command line as a timestamped line to w, ahead of the output of the command, as per -banner.
+func writeBanner(w *timestamps.TimestampedWriter, name string, args []string) {
+	err := w.WriteLine(time.Now(), []byte(commandLine(name, args)))
+	if err == nil {
+		err = w.Flush()
+	}
+	if err != nil {
+		log.Printf("ERROR: could not output banner: %s", err)
+	}
+}
+
+// supervise runs the command as execute does, running it again each time it fails, up to -restart-max times, with a
+// timestamped line marking each restart. The delay before a restart starts at -restart-delay and doubles with each
+// failure in a row, up to maxRestartDelay; it starts over once the command has managed to run for that long. Each run
+// gets writers of its own, so that -delta starts over, while -millis and -elapsed keep counting from the first start.
+// The errors of the runs that get restarted are logged, that of the last run is returned along with its status.
+func supervise(ctx context.Context, name string, args []string, cfg *config) (int, error) {
+	delay := *restartDelay
+	for attempt := 1; ; attempt++ {
+		began := time.Now()
+		status, err := execute(ctx, name, args, cfg)
+		if status == 0 || status == timestamps.ExitCommandFailed || interrupted.Load() {
+			return status, err
+		}
+		if 0 < *restartMax && *restartMax < attempt {
+			return status, err
 		}
-		_, err = tsw.writer.Write([]byte(timestamp))
 		if err != nil {
-			return 0, err
+			log.Printf("ERROR: %s", err)
 		}
 
-		var sep = "| "
-		if tsw.tabs {
-			sep = "|\t"
+		if maxRestartDelay <= time.Since(began) {
+			delay = *restartDelay
 		}
-		_, err = tsw.writer.Write([]byte(sep))
-		if err != nil {
-			return 0, err
+		time.Sleep(delay)
+		if delay *= 2; maxRestartDelay < delay {
+			delay = maxRestartDelay
 		}
 
-		if 0 < len(tsw.incomplete) {
-			_, err = tsw.writer.Write(tsw.incomplete)
-			if err != nil {
-				return 0, err
-			}
+		notice(cfg, nil, fmt.Sprintf("--- restarting (attempt %d) ---", attempt+1))
+	}
+}
+
+// notice outputs a timestamped line of ts's own to stderr, as a marker between the lines of the command; mu is that
+// of the writers of the command still running, if any.
+func notice(cfg *config, mu *sync.Mutex, text string) {
+	w := cfg.newWriter(cfg.stderr, "ts", false, mu)
+	err := w.WriteLine(time.Now(), []byte(text))
+	if err == nil {
+		err = w.Close()
+	}
+	if err != nil && !timestamps.IsClosedPipe(err) {
+		log.Printf("ERROR: could not write output: %s", err)
+	}
+}
+
+// printDryRun prints what running the command would involve as per -dry-run, the command with its path resolved, the
+// working directory and the environment settings, and returns the exit status ts should terminate with.
+func printDryRun(cliArgs []string) int {
+	if len(cliArgs) < 1 {
+		fmt.Println("no command: stdin would be timestamped")
+		return 0
+	}
+
+	status := 0
+	name := cliArgs[0]
+	if path, err := exec.LookPath(name); err == nil {
+		name = path
+	} else {
+		log.Printf("ERROR: could not find command: %s", err)
+		status = timestamps.ExitCommandFailed
+	}
+	workDir := *dir
+	if workDir == "" {
+		workDir, _ = os.Getwd()
+	}
+
+	fmt.Println("command:", quoteCommand(name, cliArgs[1:]))
+	fmt.Println("directory:", workDir)
+	for _, setting := range env {
+		name, value, _ := strings.Cut(setting, "=")
+		fmt.Printf("environment: %s=%s\n", name, shellQuote(value))
+	}
+	return status
+}
+
+// commandLine renders the command as it could be typed in a shell, for the banner: "$ make -j4", or
+// "$ cd dir && make -j4" with -C.
+func commandLine(name string, args []string) string {
+	if *dir != "" {
+		return "$ cd " + shellQuote(*dir) + " && " + quoteCommand(name, args)
+	}
+	return "$ " + quoteCommand(name, args)
+}
+
+// quoteCommand renders the command name and its arguments, each quoted for a shell as needed.
+func quoteCommand(name string, args []string) string {
+	quoted := []string{shellQuote(name)}
+	for _, arg := range args {
+		quoted = append(quoted, shellQuote(arg))
+	}
+	return strings.Join(quoted, " ")
+}
+
+// shellQuote quotes s for a shell, unless it is made of characters that need no quoting.
+func shellQuote(s string) string {
+	const safe = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789-_./:=+,@%"
+	if s != "" && strings.Trim(s, safe) == "" {
+		return s
+	}
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// printSummary reports on stderr how a run of the command went: how long it took, the number of lines on each stream,
+// the longest gap between two lines, and the exit status.
+func printSummary(wall time.Duration, streams []stream, status int) {
+	var (
+		counts []string
+		maxGap time.Duration
+	)
+	for _, s := range streams {
+		lines, gap := s.out.Stats()
+		counts = append(counts, fmt.Sprintf("%d on %s", lines, s.name))
+		if maxGap < gap {
+			maxGap = gap
 		}
-		tsw.incomplete = last
+	}
 
-		_, err = tsw.writer.Write(line)
-		if err != nil {
-			return 0, err
+	_, _ = fmt.Fprintf(os.Stderr, "ts: ran for %v, lines: %s, slowest gap: %v, exit status: %d\n",
+		wall.Round(time.Millisecond), strings.Join(counts, ", "), maxGap.Round(time.Millisecond), status)
+}
+
+// interrupted tells whether ts got a signal to relay to the child: the user wants the command gone, not restarted.
+var interrupted atomic.Bool
+
+// shellPath returns the shell commands given as strings are run with, $SHELL or else /bin/sh.
+func shellPath() string {
+	shell := os.Getenv("SHELL")
+	if shell == "" {
+		shell = "/bin/sh"
+	}
+	return shell
+}
+
+// filter timestamps the lines read from standard input, and returns the exit status ts should terminate with.
+func filter(cfg *config) int {
+	stdout := cfg.newWriter(cfg.stdout, "stdin", *label, nil)
+
+	err := stdout.Copy(os.Stdin)
+	closeWriters(stdout)
+	if err != nil && !timestamps.IsClosedPipe(err) {
+		log.Printf("ERROR: could not read from stdin: %s", err)
+		return 1
+	}
+
+	return 0
+}
+
+// closeWriters flushes the final partial line of each writer.
+func closeWriters(writers ...*timestamps.TimestampedWriter) {
+	for _, w := range writers {
+		err := w.Close()
+		if err != nil && !timestamps.IsClosedPipe(err) {
+			log.Printf("ERROR: could not flush output: %s", err)
 		}
+	}
+}
 
-		_, err = tsw.writer.Write([]byte("\n"))
-		if err != nil {
-			return 0, err
+// useColor decides whether the output written to w is colorized, timestamps and highlighting of slow lines alike, as
+// per -color: setting NO_COLOR in the environment disables colors altogether, and with -color auto, setting FORCE_COLOR
+// (to anything but 0) enables them when w is not a terminal, as for CI logs rendering ANSI sequences.
+func useColor(w io.Writer) bool {
+	if os.Getenv("NO_COLOR") != "" {
+		return false
+	}
+
+	switch *color {
+	case "always":
+		return true
+	case "never":
+		return false
+	default:
+		if force := os.Getenv("FORCE_COLOR"); force != "" {
+			return force != "0"
+		}
+		if tw, ok := w.(*tailWriter); ok {
+			w = tw.dst
 		}
+		f, ok := w.(*os.File)
+		return ok && timestamps.IsTerminal(f)
+	}
+}
+
+// isLineBuffered decides whether the output written to w is flushed after each line, as per -line-buffered: by default,
+// when w is a terminal, for lines to show as soon as they come. Otherwise, the output is flushed before waiting on more
+// input, batching the lines that come in bursts.
+func isLineBuffered(w io.Writer) bool {
+	if isFlagSet("line-buffered") {
+		return *lineBuffered
 	}
 
-	return len(p), nil
+	f, ok := w.(*os.File)
+	return ok && timestamps.IsTerminal(f)
 }
 
-func execute(name string, args []string, tf TimeFormat) {
-	var err error
+// stream is one of the streams of the command, with the writer timestamping it, for the summary to report on.
+type stream struct {
+	name string
+	out  *timestamps.TimestampedWriter
+}
+
+// createOutput creates the file at path for the timestamped output to be written to, or fails; compressed with gzip if
+// the name of the file ends in .gz. With -append, the file is appended to instead: output is written in whole lines, a
+// buffer of them at a time, so that several instances of ts appending to the same file do not interleave mid-line, as
+// long as lines are shorter than the outputBufferSize of the buffers, and the file is local (O_APPEND is not atomic
+// over NFS).
+func createOutput(path string) io.WriteCloser {
+	flags := os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	if *appendOutput {
+		flags = os.O_WRONLY | os.O_CREATE | os.O_APPEND
+	}
+
+	f, err := os.OpenFile(path, flags, 0666)
+	if err != nil {
+		log.Fatalf("ERROR: could not open output file: %s", err)
+	}
+
+	if strings.HasSuffix(path, ".gz") {
+		return newGzipFile(f)
+	}
+	return f
+}
 
-	if *verbose {
-		log.Printf("invoking command: %v, args: %v", name, args)
+// createSyslogOutput connects to syslog, for the timestamped output to be sent as messages at the named severity, or
+// fails.
+func createSyslogOutput(severity string, tag string) io.WriteCloser {
+	w, err := newSyslogWriter(severity, tag)
+	if err != nil {
+		log.Fatalf("ERROR: could not connect to syslog: %s", err)
 	}
-	cmd := exec.Command(name, args...)
 
-	stdoutIn, err := cmd.StdoutPipe()
+	return w
+}
+
+// createRotatingOutput creates the file at path for the timestamped output to be written to, rotated as per
+// -rotate-size and -rotate-keep, or -rotate-interval, or fails; lines end with terminator, for them to be kept whole.
+func createRotatingOutput(path string, terminator string) io.WriteCloser {
+	if *rotateInterval != 0 {
+		if *rotateInterval < time.Second {
+			log.Fatalf("illegal rotation interval: %v", *rotateInterval)
+		}
+
+		f, err := createPeriodicFile(path, *rotateInterval, terminator)
+		if err != nil {
+			log.Fatalf("ERROR: could not open output file: %s", err)
+		}
+		return f
+	}
+
+	maxSize, err := parseSize(*rotateSize)
 	if err != nil {
-		log.Fatalf("ERROR: could not connect to stdout pipe: %s", err)
+		log.Fatal(err)
+	}
+	if *rotateKeep < 0 {
+		log.Fatalf("illegal number of rotated files: %v", *rotateKeep)
 	}
 
-	stderrIn, err := cmd.StderrPipe()
+	f, err := createRotatingFile(path, maxSize, *rotateKeep, *appendOutput, terminator)
 	if err != nil {
-		log.Fatalf("ERROR: could not connect to stderr pipe: %s", err)
+		log.Fatalf("ERROR: could not open output file: %s", err)
 	}
 
-	stdout := NewTimestampedWriter(os.Stdout, tf, utc, millis, tabs)
-	stderr := NewTimestampedWriter(os.Stderr, tf, utc, millis, tabs)
+	return f
+}
 
-	err = cmd.Start()
+// parseStyle resolves the timestamp format, either a format name, a Go time layout or a strftime(3) format as per
+// -strftime, into a style; zone is the flag setting the time zone, if any, for a warning when it does not apply.
+func parseStyle(format string, zone string) style {
+	var (
+		tf     = timestamps.CUSTOM
+		layout string
+		err    error
+	)
+	if *strftime || strings.Contains(format, "%") {
+		layout, err = timestamps.StrftimeLayout(format)
+		if err == nil {
+			layout, err = timestamps.ValidateLayout(layout)
+		}
+	} else {
+		tf, layout, err = timestamps.ParseFormat(format)
+	}
 	if err != nil {
-		log.Fatalf("ERROR: could not start: '%s'\n", err)
+		log.Fatal(err)
+	}
+	epoch := tf == timestamps.UNIX || tf == timestamps.UNIXMILLI || tf == timestamps.UNIXNANO
+	if epoch && zone != "" {
+		warnf("-%s will be ignored when -format %s is specified.", zone, format)
+	}
+	if (epoch || tf == timestamps.ISOWeek) && 0 < *precision {
+		warnf("-precision will be ignored when -format %s is specified.", format)
+	}
+	if epoch && *bothZones {
+		warnf("-both-zones will be ignored when -format %s is specified.", format)
 	}
 
-	processStreams(stdout, stdoutIn, stderr, stderrIn)
+	return style{timeFormat: tf, layout: layout}
+}
 
-	err = cmd.Wait()
+// writeCSVHeader outputs the header row of the CSV records to w.
+func writeCSVHeader(w io.Writer) {
+	header := timestamps.CSVHeader
+	if *crlf {
+		header = strings.TrimSuffix(header, "\n") + "\r\n"
+	}
+	_, err := io.WriteString(w, header)
 	if err != nil {
-		log.Fatalf("ERROR: command failed: %s", err)
+		log.Printf("ERROR: could not output CSV header: %s", err)
 	}
 }
 
-func processStreams(stdout *TimestampedWriter, stdoutIn io.ReadCloser, stderr *TimestampedWriter, stderrIn io.ReadCloser) {
-	var wg sync.WaitGroup
+// fieldKinds maps the field names accepted by -json-keys to the fields of the records.
+var fieldKinds = map[string]timestamps.FieldKind{
+	"time":    timestamps.TimeField,
+	"stream":  timestamps.StreamField,
+	"message": timestamps.MessageField,
+}
 
-	wg.Add(2)
+// parseFields parses the fields of the records as per -json-keys: a comma-separated list of field names, each with
+// the key it goes by, as in time=ts,message=msg, in the order they are to come in. A field with no key goes by its
+// own name. The message is not to be left out.
+func parseFields(spec string) ([]timestamps.Field, error) {
+	var fields []timestamps.Field
+	seen, keys := make(map[string]bool), make(map[string]bool)
+	for _, item := range strings.Split(spec, ",") {
+		name, key, found := strings.Cut(strings.TrimSpace(item), "=")
+		if !found {
+			key = name
+		}
+		kind, ok := fieldKinds[name]
+		if !ok {
+			return nil, fmt.Errorf("illegal field: %v (one of %s)", name, strings.Join(sortedKeys(fieldKinds), ", "))
+		}
+		if key == "" || strings.ContainsAny(key, " \"=") {
+			return nil, fmt.Errorf("illegal key of the %s field: %q", name, key)
+		}
+		if seen[name] {
+			return nil, fmt.Errorf("illegal fields: %v (%s given twice)", spec, name)
+		}
+		if keys[key] {
+			return nil, fmt.Errorf("illegal fields: %v (key %s given twice)", spec, key)
+		}
+		seen[name], keys[key] = true, true
 
-	go func() {
-		_, err := io.Copy(stdout, stdoutIn)
-		if err != nil {
-			log.Fatal(err)
+		fields = append(fields, timestamps.Field{Kind: kind, Key: key})
+	}
+	if !seen["message"] {
+		return nil, fmt.Errorf("illegal fields: %v (no message)", spec)
+	}
+
+	return fields, nil
+}
+
+// prefixPlaceholder matches the placeholders of -prefix-template, as in {host}.
+var prefixPlaceholder = regexp.MustCompile(`\{[^{}]*\}`)
+
+// expandPrefix fills in the placeholders of the -prefix-template template: {host} with the host name, {pid} with the
+// process ID given, and {env:NAME} with the value of the environment variable NAME, empty if not set. It fails on any
+// other placeholder.
+func expandPrefix(template string, pid int) (string, error) {
+	var err error
+	expanded := prefixPlaceholder.ReplaceAllStringFunc(template, func(placeholder string) string {
+		name := placeholder[1 : len(placeholder)-1]
+		switch {
+		case name == "host":
+			host, hostErr := os.Hostname()
+			if hostErr != nil && err == nil {
+				err = fmt.Errorf("could not get host name: %w", hostErr)
+			}
+			return host
+		case name == "pid":
+			return strconv.Itoa(pid)
+		case strings.HasPrefix(name, "env:"):
+			return os.Getenv(strings.TrimPrefix(name, "env:"))
+		default:
+			if err == nil {
+				err = fmt.Errorf("illegal placeholder: %v (one of {host}, {pid} and {env:NAME})", placeholder)
+			}
+			return placeholder
 		}
-		wg.Done()
-	}()
+	})
 
-	go func() {
-		_, err := io.Copy(stderr, stderrIn)
-		if err != nil {
-			log.Fatal(err)
+	return expanded, err
+}
+
+// writeJSONArray outputs the opening or the closing of the array of -json-array to w.
+func writeJSONArray(w io.Writer, s string) {
+	if *crlf {
+		s = strings.ReplaceAll(s, "\n", "\r\n")
+	}
+	_, err := io.WriteString(w, s)
+	if err != nil && !timestamps.IsClosedPipe(err) {
+		log.Printf("ERROR: could not output JSON array: %s", err)
+	}
+}
+
+// signalNames maps the names accepted by -kill-signal to the signals.
+var signalNames = map[string]syscall.Signal{
+	"HUP":  syscall.SIGHUP,
+	"INT":  syscall.SIGINT,
+	"QUIT": syscall.SIGQUIT,
+	"ABRT": syscall.SIGABRT,
+	"KILL": syscall.SIGKILL,
+	"ALRM": syscall.SIGALRM,
+	"TERM": syscall.SIGTERM,
+}
+
+// parseSignal returns the signal of the given name, as in TERM or SIGTERM regardless of case, or fails.
+func parseSignal(name string) syscall.Signal {
+	sig, ok := signalNames[strings.TrimPrefix(strings.ToUpper(name), "SIG")]
+	if !ok {
+		log.Fatalf("illegal signal: %v (one of %s)", name, strings.Join(sortedKeys(signalNames), ", "))
+	}
+	return sig
+}
+
+// utcOffsetPattern matches the offsets accepted by -utc-offset, as in +05:30 or -0800.
+var utcOffsetPattern = regexp.MustCompile(`^([+-])([0-9]{2}):?([0-9]{2})$`)
+
+// parseUTCOffset returns the fixed time zone at the given offset from UTC, as in +05:30 or -08:00; it needs no tzdata,
+// unlike time.LoadLocation.
+func parseUTCOffset(offset string) (*time.Location, error) {
+	m := utcOffsetPattern.FindStringSubmatch(offset)
+	if m == nil {
+		return nil, fmt.Errorf("illegal UTC offset: %v (expected +HH:MM or -HH:MM)", offset)
+	}
+	hours, _ := strconv.Atoi(m[2])
+	minutes, _ := strconv.Atoi(m[3])
+	if 14 < hours || 59 < minutes {
+		return nil, fmt.Errorf("illegal UTC offset: %v (out of range)", offset)
+	}
+
+	seconds := hours*3600 + minutes*60
+	if m[1] == "-" {
+		seconds = -seconds
+	}
+	return time.FixedZone("", seconds), nil
+}
+
+// isFormatArg tells whether arg, the only argument, is to be taken as the time format, in the manner of moreutils ts:
+// it must look like one, and not be a command that can be run.
+func isFormatArg(arg string) bool {
+	if _, err := exec.LookPath(arg); err == nil {
+		return false
+	}
+	if *strftime || strings.Contains(arg, "%") {
+		return true
+	}
+
+	_, _, err := timestamps.ParseFormat(arg)
+	return err == nil
+}
+
+// printFormats lists the known format names, each with the current time rendered in it, in location if not nil.
+func printFormats(location *time.Location) {
+	if location == nil && *utc {
+		location = time.UTC
+	}
+	for _, name := range timestamps.FormatNames() {
+		tf, layout, _ := timestamps.ParseFormat(name)
+
+		/* rendered by a writer proper, for the example to be exactly what -format gives */
+		var example bytes.Buffer
+		w := timestamps.NewTimestampedWriter(&example, "", timestamps.WithFormat(tf, layout),
+			timestamps.WithLocation(location), timestamps.WithSeparator(""))
+		_ = w.WriteLine(time.Now(), nil)
+
+		fmt.Printf("%-12s %s", name, example.String())
+	}
+}
+
+// compileRegexp compiles the regular expression given to a flag, if any, or fails.
+func compileRegexp(expr string) *regexp.Regexp {
+	if expr == "" {
+		return nil
+	}
+
+	re, err := regexp.Compile(expr)
+	if err != nil {
+		log.Fatalf("illegal regular expression: %v (%s)", expr, err)
+	}
+	return re
+}
+
+// warnf logs a warning, unless -quiet is specified.
+func warnf(format string, args ...any) {
+	if !*quiet {
+		log.Printf("WARNING: "+format, args...)
+	}
+}
+
+// verbosef logs what ts is up to as per -verbose, unless -quiet is specified.
+func verbosef(format string, args ...any) {
+	if *verbose && !*quiet {
+		log.Printf(format, args...)
+	}
+}
+
+// isFlagSet tells whether the named flag was given on the command line, as opposed to having its default value.
+func isFlagSet(name string) bool {
+	set := false
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			set = true
+		}
+	})
+
+	return set
+}
+
+// exclusiveFlag returns which of the named boolean flags is set, if any, and fails if more than one is.
+func exclusiveFlag(names ...string) string {
+	var set string
+
+	for _, name := range names {
+		if flag.Lookup(name).Value.String() != "true" {
+			continue
+		}
+		if set != "" {
+			log.Fatalf("-%s and -%s are mutually exclusive", set, name)
 		}
-		wg.Done()
-	}()
+		set = name
+	}
 
-	wg.Wait()
+	return set
 }
 
 func init() {
+	flag.Var(&env, "env", "set `NAME=value` in the environment of the command; may be repeated")
+
 	/* timestamps in logging can easily get confused with output */
 	log.SetFlags(log.Flags() &^ (log.Ldate | log.Ltime))
 
 	flag.CommandLine.Usage = func() {
 		output := flag.CommandLine.Output()
 		_, _ = fmt.Fprintf(output, "ts - run a command with timestamped output\n\n")
-		_, _ = fmt.Fprintf(output, "usage:\n  ts [ options ] cmd args...\n\n")
+		_, _ = fmt.Fprintf(output, "usage:\n  ts [ options ] cmd args...\n")
+		_, _ = fmt.Fprintf(output, "  ts [ options ] -c 'command string' [ name args... ]\n")
+		_, _ = fmt.Fprintf(output, "  ts [ options ] -script file\n")
+		_, _ = fmt.Fprintf(output, "  cmd args... | ts [ options ] [ format ]\n\n")
+		_, _ = fmt.Fprintf(output, "when reading from a pipe, a single argument that is not a command is taken as the\n")
+		_, _ = fmt.Fprintf(output, "time format, overriding -format; a command always takes precedence.\n\n")
+		_, _ = fmt.Fprintf(output, "defaults:\n")
+		_, _ = fmt.Fprintf(output, "  TS_FORMAT, TS_TABS and TS_UTC set the defaults of -format, -tabs and -utc; the\n")
+		_, _ = fmt.Fprintf(output, "  config file sets those of any flag, as name=value lines. Flags given on the command\n")
+		_, _ = fmt.Fprintf(output, "  line take precedence over the environment, which takes precedence over the file.\n\n")
 		_, _ = fmt.Fprintf(output, "options:\n")
 		flag.PrintDefaults()
 	}
 }
 
 func main() {
+	/* with SIGPIPE handled, writing to a closed stdout fails with EPIPE rather than killing ts on the spot; the
+	handling is not inherited by the child */
+	signal.Notify(make(chan os.Signal, 1), syscall.SIGPIPE)
+
 	flag.Parse()
-	if *millis && *utc {
-		log.Printf("WARNING: -utc will be ignored when -millis is specified.")
+	flag.Visit(func(f *flag.Flag) {
+		commandLineFlags[f.Name] = true
+	})
+	applyEnvDefaults()
+	applyConfigDefaults()
+	if *completionShell != "" {
+		err := printCompletion(os.Stdout, *completionShell)
+		if err != nil {
+			log.Fatal(err)
+		}
+		os.Exit(0)
 	}
-	var tf TimeFormat
-	ok := tf.fromString(format)
-	if !ok {
-		log.Fatal(fmt.Sprintf("illegal time format identifier: %v", *format))
+	if *showVersion {
+		fmt.Printf("ts %s (%s, %s/%s)\n", version, runtime.Version(), runtime.GOOS, runtime.GOARCH)
+		os.Exit(0)
+	}
+	separator := "| "
+	if *tabs {
+		separator = "|\t"
+	}
+	if isFlagSet("sep") {
+		if *tabs {
+			warnf("-tabs will be ignored when -sep is specified.")
+		}
+		separator = *sep
+	}
+	if *color != "auto" && *color != "always" && *color != "never" {
+		log.Fatalf("illegal color mode: %v", *color)
+	}
+	if *align != "left" && *align != "right" {
+		log.Fatalf("illegal alignment: %v", *align)
+	}
+	if *prefixTemplate != "" {
+		if *prefix != "" {
+			log.Fatal("-prefix and -prefix-template are mutually exclusive")
+		}
+		_, err := expandPrefix(*prefixTemplate, os.Getpid())
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	if *width < 0 {
+		log.Fatalf("illegal width: %v", *width)
+	}
+	if isFlagSet("align") && *width == 0 {
+		warnf("-align will be ignored unless -width is specified.")
+	}
+	if *precision < 0 || 9 < *precision {
+		log.Fatalf("illegal precision: %v", *precision)
+	}
+	if *blankLines != "stamp" && *blankLines != "bare" && *blankLines != "skip" {
+		log.Fatalf("illegal blank lines mode: %v", *blankLines)
+	}
+	if *seqWidth < 0 {
+		log.Fatalf("illegal sequence width: %v", *seqWidth)
+	}
+	if *seqPerStream && !*seq {
+		warnf("-seq-per-stream will be ignored unless -seq is specified.")
+	}
+	if *millisWidth < 0 || *millisPrecision < 0 || 9 < *millisPrecision {
+		log.Fatalf("illegal -millis-width %v or -millis-precision %v", *millisWidth, *millisPrecision)
+	}
+	if *tail < 0 {
+		log.Fatalf("illegal number of lines: %v", *tail)
+	}
+	if *maxLine < 0 || (0 < *maxLine && *maxLine < 16) {
+		log.Fatalf("illegal line length: %v (at least 16)", *maxLine)
+	}
+	if 0 < *maxLine && (0 < *flushInterval || *cr) {
+		warnf("-max-line will be ignored when -flush-interval or -cr is specified.")
+	}
+	if *dir != "" {
+		info, err := os.Stat(*dir)
+		if err == nil && !info.IsDir() {
+			err = fmt.Errorf("%s: not a directory", *dir)
+		}
+		if err != nil {
+			log.Fatalf("ERROR: illegal working directory: %s", err)
+		}
+	}
+	if *restartMax < 0 || *restartDelay < 0 {
+		log.Fatalf("illegal restart settings: -restart-max %v, -restart-delay %v", *restartMax, *restartDelay)
+	}
+	if *rotateSize != "" && *output == "" {
+		log.Fatal("-rotate-size requires -o")
+	}
+	if *rotateInterval != 0 && *output == "" {
+		log.Fatal("-rotate-interval requires -o")
+	}
+	destinations := 0
+	for _, set := range []bool{*output != "", *useSyslog, *netAddress != ""} {
+		if set {
+			destinations++
+		}
+	}
+	if 1 < destinations {
+		log.Fatal("-o, -syslog and -net are mutually exclusive")
+	}
+	if *syslogPriority != "" && !*useSyslog {
+		warnf("-syslog-priority will be ignored unless -syslog is specified.")
+	}
+	if strings.HasSuffix(*output, ".gz") && (*rotateSize != "" || *rotateInterval != 0) {
+		warnf("-o %s will not be compressed when -rotate-size or -rotate-interval is specified.", *output)
+	}
+	if *appendOutput && *output == "" && *tee == "" {
+		warnf("-append will be ignored unless -o or -tee is specified.")
+	}
+	if *rotateSize != "" && *rotateInterval != 0 {
+		log.Fatal("-rotate-size and -rotate-interval are mutually exclusive")
+	}
+	encoding := timestamps.TEXT
+	if structured := exclusiveFlag("json", "json-array", "logfmt", "csv"); structured != "" {
+		if 0 < *flushInterval {
+			warnf("-flush-interval will be ignored when -%s is specified.", structured)
+		}
+		if *prefix != "" || *prefixTemplate != "" {
+			warnf("-prefix and -prefix-template will be ignored when -%s is specified.", structured)
+		}
+		if *match != "" {
+			warnf("-match will be ignored when -%s is specified.", structured)
+		}
+		if *seq {
+			warnf("-seq will be ignored when -%s is specified.", structured)
+		}
+		if *quote {
+			warnf("-quote will be ignored when -%s is specified.", structured)
+		}
+		if *blankLines == "bare" {
+			warnf("-blank-lines bare will be ignored when -%s is specified.", structured)
+		}
+		encoding = timestamps.JSON
+		if *logfmt {
+			encoding = timestamps.LOGFMT
+		} else if *csvOutput {
+			encoding = timestamps.CSV
+		}
+	}
+	var fields []timestamps.Field
+	if *jsonKeys != "" {
+		if encoding != timestamps.JSON && encoding != timestamps.LOGFMT {
+			warnf("-json-keys will be ignored unless -json, -json-array or -logfmt is specified.")
+		}
+
+		var err error
+		fields, err = parseFields(*jsonKeys)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	if !*stampStderr && (*merge || *usePty) {
+		warnf("-stamp-stderr will be ignored when -merge or -pty is specified, -stamp-stdout applies.")
+	}
+	if *label && *merge {
+		warnf("-label will be ignored when -merge is specified.")
+	}
+	if *label && *usePty {
+		warnf("-label will be ignored when -pty is specified.")
+	}
+	var location *time.Location
+	zone := ""
+	if *utc {
+		zone = "utc"
+	}
+	if *tz != "" {
+		if *utc {
+			warnf("-utc will be ignored when -tz is specified.")
+		}
+		zone = "tz"
+
+		var err error
+		location, err = time.LoadLocation(*tz)
+		if err != nil {
+			log.Fatalf("illegal time zone: %v (%s)", *tz, err)
+		}
 	}
+	if *utcOffset != "" {
+		if *tz != "" {
+			log.Fatal("-tz and -utc-offset are mutually exclusive")
+		}
+		if *utc {
+			warnf("-utc will be ignored when -utc-offset is specified.")
+		}
+		zone = "utc-offset"
 
+		var err error
+		location, err = parseUTCOffset(*utcOffset)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	if *listFormats {
+		printFormats(location)
+		os.Exit(0)
+	}
 	cliArgs := flag.Args()
-	if len(cliArgs) < 1 {
-		flag.CommandLine.Usage()
-		os.Exit(1)
+	if *shellCommand != "" {
+		/* the arguments, if any, become $0, $1 and so on */
+		cliArgs = append([]string{shellPath(), "-c", *shellCommand}, cliArgs...)
+	} else if len(cliArgs) == 1 && !timestamps.IsTerminal(os.Stdin) && isFormatArg(cliArgs[0]) {
+		if commandLineFlags["format"] {
+			warnf("-format will be ignored when a format argument is specified.")
+		}
+		*format, cliArgs = cliArgs[0], nil
+	}
+	if *keepGoing && *script == "" {
+		warnf("-keep-going will be ignored unless -script is specified.")
 	}
+	var commands []string
+	if *script != "" {
+		if 0 < len(cliArgs) {
+			log.Fatal("-script and a command are mutually exclusive")
+		}
 
-	name := cliArgs[0]
-	args := cliArgs[1:]
+		var err error
+		commands, err = readScript(*script)
+		if err != nil {
+			log.Fatalf("ERROR: could not read script: %s", err)
+		}
+		if len(commands) == 0 {
+			log.Fatalf("ERROR: no commands in script: %s", *script)
+		}
+	}
+	mode := exclusiveFlag("millis", "micros", "nanos", "elapsed", "human", "delta", "since-epoch")
+	var base time.Time
+	if *relativeTo != "" {
+		/* the origin of -since-epoch, if specified */
+		if mode != "" && !*sinceEpoch {
+			log.Fatalf("-%s and -relative-to are mutually exclusive", mode)
+		}
+		if mode == "" {
+			mode = "relative-to"
+		}
+
+		var err error
+		base, err = time.Parse(time.RFC3339Nano, *relativeTo)
+		if err != nil {
+			log.Fatalf("illegal base time: %v (%s)", *relativeTo, err)
+		}
+	}
+	if mode != "" && zone != "" {
+		warnf("-%s will be ignored when -%s is specified.", zone, mode)
+	}
+	if mode != "" && *dual {
+		warnf("-dual will be ignored when -%s is specified.", mode)
+	}
+	if mode != "" && *bothZones {
+		warnf("-both-zones will be ignored when -%s is specified.", mode)
+	}
+	if mode != "" && !*sinceEpoch && 0 < *precision {
+		warnf("-precision will be ignored when -%s is specified.", mode)
+	}
+	if (isFlagSet("millis-width") || isFlagSet("millis-precision")) && sinceStartUnits[mode] == 0 {
+		warnf("-millis-width and -millis-precision will be ignored unless -millis, -micros or -nanos is specified.")
+	}
+	stdoutStyle := parseStyle(*format, zone)
+	stderrStyle := stdoutStyle
+	if *stderrFormat != "" {
+		stderrStyle = parseStyle(*stderrFormat, zone)
+	}
+	if *stderrColor != "" {
+		sgr, ok := colorSequences[*stderrColor]
+		if !ok {
+			log.Fatalf("illegal color: %v", *stderrColor)
+		}
+		stderrStyle.color = sgr
+	}
+	if (*stderrFormat != "" || *stderrColor != "") && (*merge || *usePty) {
+		warnf("-stderr-format and -stderr-color will be ignored when -merge or -pty is specified.")
+	}
+
+	if *nulNewline && !*nul {
+		warnf("-0-newline will be ignored unless -0 is specified.")
+	}
+	if *crlf && *keepCR {
+		warnf("-keep-cr will be ignored when -crlf is specified.")
+	}
+	if *crlf && *nul && !*nulNewline {
+		warnf("-crlf will be ignored when -0 is specified, unless with -0-newline.")
+	}
+	if *cr && *nul {
+		warnf("-cr will be ignored when -0 is specified.")
+	}
+
+	matchRE, grepRE := compileRegexp(*match), compileRegexp(*grep)
+	if grepRE != nil && 0 < *flushInterval {
+		warnf("-flush-interval will be ignored when -grep is specified.")
+	}
+	if *dedup && 0 < *flushInterval {
+		warnf("-flush-interval will be ignored when -dedup is specified.")
+	}
+	if *quote && 0 < *flushInterval {
+		warnf("-flush-interval will be ignored when -quote is specified.")
+	}
+	if *grepInvert && grepRE == nil {
+		warnf("-grep-invert will be ignored unless -grep is specified.")
+	}
+
+	cfg := &config{
+		style:       stdoutStyle,
+		stderrStyle: stderrStyle,
+		location:    location,
+		separator:   separator,
+		encoding:    encoding,
+		sinceStart:  sinceStartUnits[mode],
+		millisWidth: -1,
+		fields:      fields,
+		killSignal:  parseSignal(*killSignal),
+		base:        base,
+		match:       matchRE,
+		grep:        grepRE,
+		delimiter:   '\n',
+		terminator:  "\n",
+		keepCR:      *keepCR,
+		stdout:      os.Stdout,
+		stderr:      os.Stderr,
+	}
+
+	if *bothZones {
+		/* UTC, unless that is the zone of the time proper */
+		cfg.secondZone = time.UTC
+		if zone == "utc" {
+			cfg.secondZone = time.Local
+		}
+	}
+	if 0 < *millisWidth {
+		cfg.millisWidth = *millisWidth
+	}
+	if isFlagSet("kill-signal") {
+		cfg.stopSignal = cfg.killSignal
+	}
+	if *crlf {
+		/* the carriage returns kept would come doubled */
+		cfg.terminator, cfg.keepCR = "\r\n", false
+	}
+	if *nul {
+		cfg.delimiter = 0
+		if !*nulNewline {
+			cfg.terminator = "\x00"
+		}
+	}
+
+	if *statsInterval < 0 {
+		log.Fatalf("illegal stats interval: %v", *statsInterval)
+	}
+	if 0 < *statsInterval && len(cliArgs) < 1 && commands == nil {
+		warnf("-stats-interval will be ignored unless a command is specified.")
+	}
 
-	execute(name, args, tf)
+	if *dryRun {
+		status := 0
+		for _, command := range commands {
+			if s := printDryRun([]string{shellPath(), "-c", command}); status == 0 {
+				status = s
+			}
+		}
+		if commands == nil {
+			status = printDryRun(cliArgs)
+		}
+		os.Exit(status)
+	}
+
+	var outputFiles []io.Closer
+	if *output != "" {
+		var f io.WriteCloser
+		if *rotateSize != "" || *rotateInterval != 0 {
+			f = createRotatingOutput(*output, cfg.recordEnd())
+		} else {
+			f = createOutput(*output)
+		}
+		cfg.stdout, cfg.stderr = f, f
+		outputFiles = append(outputFiles, f)
+	}
+	if *useSyslog && *jsonArray {
+		log.Fatal("-syslog and -json-array are mutually exclusive")
+	}
+	if *useSyslog {
+		tag := "ts"
+		if 0 < len(cliArgs) {
+			tag = filepath.Base(cliArgs[0])
+		} else if *script != "" {
+			tag = filepath.Base(*script)
+		}
+		stdoutSeverity, stderrSeverity := "info", "err"
+		if *syslogPriority != "" {
+			stdoutSeverity, stderrSeverity = *syslogPriority, *syslogPriority
+		}
+
+		stdout, stderr := createSyslogOutput(stdoutSeverity, tag), createSyslogOutput(stderrSeverity, tag)
+		cfg.stdout, cfg.stderr = stdout, stderr
+		outputFiles = append(outputFiles, stdout, stderr)
+	}
+	if *netAddress != "" {
+		nw, err := dialNet(*netAddress)
+		if err != nil {
+			log.Fatalf("ERROR: could not connect to %s: %s", *netAddress, err)
+		}
+		cfg.stdout, cfg.stderr = nw, nw
+		outputFiles = append(outputFiles, nw)
+	}
+	if encoding == timestamps.CSV {
+		/* a single header, on stdout or the -o file: the records tell the streams apart, and the two of them
+		captured together are then a single valid CSV document */
+		writeCSVHeader(cfg.stdout)
+	}
+	if *tee != "" {
+		f := createOutput(*tee)
+		if encoding == timestamps.CSV {
+			writeCSVHeader(f)
+		}
+		cfg.stdout, cfg.stderr = io.MultiWriter(cfg.stdout, f), io.MultiWriter(cfg.stderr, f)
+		outputFiles = append(outputFiles, f)
+	}
+	if *jsonArray {
+		/* a single document, that of all the streams */
+		cfg.stderr = cfg.stdout
+		cfg.jsonArray = new(atomic.Bool)
+		writeJSONArray(cfg.stdout, timestamps.JSONArrayOpening)
+	}
+	arrayOutput := cfg.stdout
+
+	var tb *tailBuffer
+	if 0 < *tail {
+		tb = newTailBuffer(*tail, cfg.recordEnd())
+		stdout := tb.writer(cfg.stdout)
+		if cfg.stderr == cfg.stdout {
+			cfg.stdout, cfg.stderr = stdout, stdout
+		} else {
+			cfg.stdout, cfg.stderr = stdout, tb.writer(cfg.stderr)
+		}
+	}
+
+	var status int
+	if commands != nil {
+		var err error
+		status, err = runScript(context.Background(), commands, cfg)
+		if err != nil {
+			log.Printf("ERROR: %s", err)
+		}
+	} else if len(cliArgs) < 1 {
+		/* with no command to run, act as a filter on stdin; unless there is nothing piped in */
+		if timestamps.IsTerminal(os.Stdin) {
+			flag.CommandLine.Usage()
+			os.Exit(1)
+		}
+		status = filter(cfg)
+	} else {
+		name := cliArgs[0]
+		args := cliArgs[1:]
+
+		var err error
+		if *restart {
+			status, err = supervise(context.Background(), name, args, cfg)
+		} else {
+			status, err = execute(context.Background(), name, args, cfg)
+		}
+		if err != nil {
+			log.Printf("ERROR: %s", err)
+		}
+	}
+
+	if tb != nil {
+		err := tb.flush()
+		if err != nil && !timestamps.IsClosedPipe(err) {
+			log.Printf("ERROR: could not write output: %s", err)
+		}
+	}
+	if *jsonArray {
+		writeJSONArray(arrayOutput, timestamps.JSONArrayClosing)
+	}
+	for _, f := range outputFiles {
+		err := f.Close()
+		if err != nil {
+			log.Printf("ERROR: could not close output file: %s", err)
+			if status == 0 {
+				status = 1
+			}
+		}
+	}
+	os.Exit(status)
 }
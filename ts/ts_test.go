@@ -0,0 +1,69 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+)
+
+// TestMain runs ts itself, rather than the tests, in the test binary run by runTS.
+func TestMain(m *testing.M) {
+	if os.Getenv("TS_TEST_RUN_MAIN") == "1" {
+		main()
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+// runTS runs ts with the arguments, sparing it any config file, and returns what it output on stdout and stderr, along
+// with the error it exited with, if any.
+func runTS(t *testing.T, args ...string) (string, string, error) {
+	t.Helper()
+
+	home := t.TempDir()
+	cmd := exec.Command(os.Args[0], args...)
+	cmd.Env = append(os.Environ(), "TS_TEST_RUN_MAIN=1", "HOME="+home, "XDG_CONFIG_HOME="+home)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	err := cmd.Run()
+	return stdout.String(), stderr.String(), err
+}
+
+func TestCSVHeaderOnce(t *testing.T) {
+	stdout, stderr, err := runTS(t, "-csv", "--", "sh", "-c", "echo out; echo err >&2")
+	if err != nil {
+		t.Fatalf("ts -csv: %v (%s)", err, stderr)
+	}
+
+	all := stdout + stderr
+	if got := strings.Count(all, "timestamp,stream,message\n"); got != 1 {
+		t.Errorf("%d header rows; want 1 in %q", got, all)
+	}
+	if !strings.HasPrefix(stdout, "timestamp,stream,message\n") {
+		t.Errorf("stdout = %q; want the header first", stdout)
+	}
+	for _, record := range []string{",stdout,out\n", ",stderr,err\n"} {
+		if !strings.Contains(all, record) {
+			t.Errorf("no %q record in %q", record, all)
+		}
+	}
+}
+
+func TestMaxLineTooSmall(t *testing.T) {
+	for _, n := range []string{"1", "15"} {
+		_, stderr, err := runTS(t, "-max-line", n, "--", "true")
+		if err == nil || !strings.Contains(stderr, "illegal line length: "+n+" (at least 16)") {
+			t.Errorf("-max-line %s: %v, %q; want it rejected", n, err, stderr)
+		}
+	}
+
+	stdout, stderr, err := runTS(t, "-max-line", "16", "--", "echo", strings.Repeat("x", 20))
+	if err != nil {
+		t.Fatalf("-max-line 16: %v (%s)", err, stderr)
+	}
+	if got := strings.Count(stdout, "\n"); got != 2 {
+		t.Errorf("-max-line 16: %d lines of output; want 2 in %q", got, stdout)
+	}
+}
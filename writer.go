@@ -0,0 +1,1170 @@
+package timestamps
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+// start is the origin of the elapsed time modes, unless a clock of its own is given to the writer.
+var start = time.Now()
+
+// Encoding identifies how the timestamped lines are rendered.
+type Encoding int
+
+// The supported encodings: TEXT prepends the timestamp to the line, JSON renders the line as a JSON object, as in
+// {"ts":"...","stream":"stdout","message":"..."}, LOGFMT as key=value pairs, as in ts=... stream=stdout msg="...", and
+// CSV as an RFC 4180 record with timestamp, stream and message fields; one per line of output.
+const (
+	TEXT Encoding = iota
+	JSON
+	LOGFMT
+	CSV
+)
+
+// FieldKind identifies one of the fields of the records of the JSON and LOGFMT encodings.
+type FieldKind int
+
+// The fields of the records: the timestamp, the name of the stream and the line itself.
+const (
+	TimeField FieldKind = iota
+	StreamField
+	MessageField
+)
+
+// Field is a field of the records of the JSON and LOGFMT encodings, with the key it goes by.
+type Field struct {
+	Kind FieldKind
+	Key  string
+}
+
+// The fields of the records of the JSON and LOGFMT encodings, unless given otherwise.
+var (
+	jsonFields   = []Field{{TimeField, "ts"}, {StreamField, "stream"}, {MessageField, "message"}}
+	logfmtFields = []Field{{TimeField, "ts"}, {StreamField, "stream"}, {MessageField, "msg"}}
+)
+
+// CSVHeader is the header row of the CSV encoding, for the caller to output once ahead of the records.
+const CSVHeader = "timestamp,stream,message\n"
+
+// JSONArrayOpening and JSONArrayClosing are what the caller outputs around the records of the JSON array mode, once
+// ahead of them and once after them, for the lot to make a single JSON document.
+const (
+	JSONArrayOpening = "["
+	JSONArrayClosing = "\n]\n"
+)
+
+// TimestampedWriter is a writer that splits text on newlines and outputs lines one at the time, prepending each
+// with a timestamp.
+type TimestampedWriter struct {
+	writer     io.Writer
+	streamName string
+	label      bool
+	timeFormat TimeFormat
+	format     string
+	location   *time.Location
+	millis     bool
+	unit       time.Duration
+	numWidth   int
+	precision  int
+	prefix     string
+	separator  string
+	color      bool
+	sgr        string
+	elapsed    bool
+	human      bool
+	delta      bool
+	slow       time.Duration
+	last       time.Time
+	lines      int
+	maxGap     time.Duration
+	cr         bool
+	afterCR    bool
+	keepCR     bool
+	delimiter  byte
+	terminator []byte
+	encoding   Encoding
+	incomplete []byte
+
+	/* serializes output, possibly with other writers sharing the same destination */
+	mu *sync.Mutex
+
+	/* the output being put together, written out in one go */
+	pending bytes.Buffer
+
+	/* the clock lines are timestamped by, and the origin of the elapsed time modes */
+	now   func() time.Time
+	start time.Time
+
+	/* whether to copy the data through untouched as per the raw mode, without even splitting it into lines */
+	raw bool
+
+	/* whether messages are quoted, as per the quote mode */
+	quote bool
+
+	/* whether WriteLine flushes the underlying writer after each line */
+	lineBuffered bool
+
+	/* the length Copy splits longer lines at, if any */
+	maxLine int
+
+	/* the lines to timestamp, and the lines to output at all, if not all of them */
+	passThrough bool
+	match       *regexp.Regexp
+	grep        *regexp.Regexp
+	grepInvert  bool
+
+	/* whether blank lines go out without a timestamp, or not at all */
+	bareBlank bool
+	skipBlank bool
+
+	/* the line held back as per the dedup mode, if enabled, with the time it first came at and how many times */
+	dedup      bool
+	repeated   []byte
+	repeatedAt time.Time
+	repeats    int
+
+	/* the origin of the relative time mode, if enabled */
+	base time.Time
+
+	/* whether to show the seconds since start, or since the origin of the relative time mode, with how many decimals */
+	seconds       bool
+	secondsDigits int
+
+	/* whether the time since start follows the absolute time */
+	dual bool
+
+	/* the number of digits of the fractions of a second following the absolute time */
+	fraction int
+
+	/* the location of the time following the absolute time, in the same layout, if any */
+	secondZone *time.Location
+
+	/* the fields of the records of the JSON and LOGFMT encodings, in order, if other than the usual ones */
+	fields []Field
+
+	/* whether any records of the JSON array mode, if enabled, have been output, by any of the writers of the array */
+	jsonArray *atomic.Bool
+
+	/* the numbering of lines, if enabled, with the number of digits to pad the numbers to */
+	sequence *atomic.Int64
+	seqWidth int
+
+	/* padding of timestamps to a column of fixed width */
+	width      int
+	alignRight bool
+
+	/* flushing of partial lines after a period of inactivity */
+	flushInterval time.Duration
+	timer         *time.Timer
+	open          bool
+	err           error
+}
+
+// NewTimestampedWriter creates a new TimestampedWriter writing the lines of the named stream (e.g. "stdout") to w. By
+// default, each line is prepended with the local time in the DEFAULT format and a "| " separator; the options tell
+// otherwise, and are applied in order.
+func NewTimestampedWriter(w io.Writer, streamName string, opts ...Option) *TimestampedWriter {
+	tf := DEFAULT
+	tsw := &TimestampedWriter{
+		writer:     w,
+		streamName: streamName,
+		timeFormat: tf,
+		format:     tf.String(),
+		unit:       time.Millisecond,
+		separator:  "| ",
+		sgr:        sgrDim,
+		delimiter:  '\n',
+		terminator: []byte("\n"),
+		encoding:   TEXT,
+		incomplete: make([]byte, 0),
+
+		now:   time.Now,
+		start: start,
+
+		numWidth:  -1,
+		precision: 3,
+	}
+	for _, opt := range opts {
+		opt(tsw)
+	}
+
+	if tsw.mu == nil {
+		tsw.mu = new(sync.Mutex)
+	}
+	if tsw.encoding != TEXT || tsw.raw || tsw.quote || tsw.grep != nil || tsw.dedup {
+		/* a record cannot be output in pieces, nor a line that may yet be transformed, held back or dropped */
+		tsw.flushInterval = 0
+	}
+
+	return tsw
+}
+
+// Option is an optional setting of a TimestampedWriter, as given to NewTimestampedWriter.
+type Option func(*TimestampedWriter)
+
+// WithFormat makes timestamps rendered as per the time format tf, layout being its layout: that String returns for
+// the predefined formats, or a validated one for CUSTOM.
+func WithFormat(tf TimeFormat, layout string) Option {
+	return func(tsw *TimestampedWriter) {
+		tsw.timeFormat = tf
+		tsw.format = layout
+	}
+}
+
+// WithLocation makes timestamps show the time in location (e.g. time.UTC) rather than the local time.
+func WithLocation(location *time.Location) Option {
+	return func(tsw *TimestampedWriter) {
+		tsw.location = location
+	}
+}
+
+// WithPrefix makes the writer output prefix before the timestamp of each line, with the TEXT encoding.
+func WithPrefix(prefix string) Option {
+	return func(tsw *TimestampedWriter) {
+		tsw.prefix = prefix
+	}
+}
+
+// WithSeparator makes the writer output separator after timestamps rather than "| ", with the TEXT encoding; it may
+// be empty.
+func WithSeparator(separator string) Option {
+	return func(tsw *TimestampedWriter) {
+		tsw.separator = separator
+	}
+}
+
+// WithLabel makes the writer tag each line with the stream it comes from after the separator, as in [out] or [err],
+// with the TEXT encoding.
+func WithLabel() Option {
+	return func(tsw *TimestampedWriter) {
+		tsw.label = true
+	}
+}
+
+// WithColors makes the writer colorize timestamps with ANSI sequences, dimming them, or coloring them as per
+// WithColor, and turning those of slow lines red.
+func WithColors() Option {
+	return func(tsw *TimestampedWriter) {
+		tsw.color = true
+	}
+}
+
+// WithElapsed makes timestamps show the time elapsed since start, as HH:MM:SS.mmm.
+func WithElapsed() Option {
+	return func(tsw *TimestampedWriter) {
+		tsw.elapsed = true
+	}
+}
+
+// WithDelta makes timestamps show the time elapsed since the previous line, as HH:MM:SS.mmm.
+func WithDelta() Option {
+	return func(tsw *TimestampedWriter) {
+		tsw.delta = true
+	}
+}
+
+// WithSlow highlights the lines coming more than slow after the previous one, with a red timestamp, or one followed
+// by a '!' without colors.
+func WithSlow(slow time.Duration) Option {
+	return func(tsw *TimestampedWriter) {
+		tsw.slow = slow
+	}
+}
+
+// WithCR makes carriage returns end lines as newlines do, for each update of a progress bar to get timestamped.
+func WithCR() Option {
+	return func(tsw *TimestampedWriter) {
+		tsw.cr = true
+	}
+}
+
+// WithKeepCR makes the writer keep the carriage return of CRLF line endings, rather than drop it.
+func WithKeepCR() Option {
+	return func(tsw *TimestampedWriter) {
+		tsw.keepCR = true
+	}
+}
+
+// WithDelimiters makes lines delimited by the delimiter byte on input, and terminated by the terminator on output,
+// rather than by newlines; e.g. for NUL-delimited records, in which case carriage returns are left alone. The records
+// of the JSON, LOGFMT and CSV encodings end with a newline regardless, or a CRLF if that is the terminator.
+func WithDelimiters(delimiter byte, terminator string) Option {
+	return func(tsw *TimestampedWriter) {
+		tsw.delimiter = delimiter
+		tsw.terminator = []byte(terminator)
+	}
+}
+
+// WithEncoding makes the writer render lines as per encoding rather than as TEXT; with JSON, LOGFMT and CSV the
+// prefix, separator, label and color settings do not apply.
+func WithEncoding(encoding Encoding) Option {
+	return func(tsw *TimestampedWriter) {
+		tsw.encoding = encoding
+	}
+}
+
+// WithFlushInterval makes the writer output partial lines after interval without further data, with the TEXT
+// encoding only, and unless lines are quoted, grepped or deduplicated.
+func WithFlushInterval(interval time.Duration) Option {
+	return func(tsw *TimestampedWriter) {
+		tsw.flushInterval = interval
+	}
+}
+
+// WithMutex makes each line output atomically with respect to other writers given the same mutex, e.g. writers of
+// streams ending up on the same terminal; otherwise, the writer has a mutex of its own.
+func WithMutex(mu *sync.Mutex) Option {
+	return func(tsw *TimestampedWriter) {
+		tsw.mu = mu
+	}
+}
+
+// WithMaxLine makes Copy split lines longer than n bytes into chunks of n bytes at most, each output as a line of its
+// own, to cap memory use; a character is never cut in half, for the chunks to remain valid UTF-8. The least cap is 16
+// bytes, that of the smallest buffer bufio reads with: n from 1 to 15 counts as 16.
+func WithMaxLine(n int) Option {
+	return func(tsw *TimestampedWriter) {
+		tsw.maxLine = n
+	}
+}
+
+// WithClock makes the writer read the time from now rather than time.Now, e.g. for deterministic output. The origin
+// of the elapsed time modes becomes the time now gives at the creation of the writer.
+func WithClock(now func() time.Time) Option {
+	return func(tsw *TimestampedWriter) {
+		tsw.now = now
+		tsw.start = now()
+	}
+}
+
+// WithMillisWidth sets the width and the number of decimals of the time since start in the millis mode, rather than
+// 12 and 3 (15 and 3 for microseconds, 15 and none for nanoseconds); a negative width or precision leaves the default.
+// Times that do not fit widen the column for the lines after them, so that they keep lining up.
+func WithMillisWidth(width int, precision int) Option {
+	return func(tsw *TimestampedWriter) {
+		if 0 <= width {
+			tsw.numWidth = width
+		}
+		if 0 <= precision {
+			tsw.precision = precision
+		}
+	}
+}
+
+// WithStart makes start the origin of the elapsed time modes, rather than the time the package was initialized at.
+// For the elapsed times to be unaffected by adjustments of the wall clock, start is to carry a monotonic clock
+// reading, as the times time.Now returns do.
+func WithStart(start time.Time) Option {
+	return func(tsw *TimestampedWriter) {
+		tsw.start = start
+	}
+}
+
+// WithSinceStart makes timestamps show the time since start in unit: time.Millisecond, time.Microsecond or
+// time.Nanosecond, as in 1234.567ms; zero leaves the time shown as it is.
+func WithSinceStart(unit time.Duration) Option {
+	return func(tsw *TimestampedWriter) {
+		if unit != 0 {
+			tsw.millis = true
+			tsw.unit = unit
+		}
+	}
+}
+
+// WithHuman makes the elapsed mode render the time in a compact humanized form, with coarser units as it grows:
+// 12.345s, 2m03s, 1h02m03s, then 2d03h04m; right-aligned, so that timestamps line up.
+func WithHuman() Option {
+	return func(tsw *TimestampedWriter) {
+		tsw.human = true
+	}
+}
+
+// WithRelativeTo makes timestamps show the time relative to base, in seconds with a sign, as in +123.456s; lines
+// before base come out negative. It takes precedence over the other modes.
+func WithRelativeTo(base time.Time) Option {
+	return func(tsw *TimestampedWriter) {
+		tsw.base = base
+	}
+}
+
+// WithPrecision makes timestamps in the time layouts end with a fraction of a second of digits digits, from 1 to 9, as
+// in 15:04:05.123 for 3, whatever the layout otherwise gives; digits out of range are clamped to it, 0 meaning no
+// fraction. It has no effect with the epoch formats, the week date of ISOWeek and the other modes.
+func WithPrecision(digits int) Option {
+	return func(tsw *TimestampedWriter) {
+		tsw.fraction = clampDigits(digits)
+	}
+}
+
+// clampDigits brings a number of decimals of a second to the range from 0 to 9, nanoseconds being the finest.
+func clampDigits(digits int) int {
+	if digits < 0 {
+		return 0
+	}
+	if 9 < digits {
+		return 9
+	}
+	return digits
+}
+
+// WithSeconds makes timestamps show the time elapsed since start in seconds, with a sign and digits decimals, as in
+// +12.345678, or since base with the relative time mode, as in +1712345678.123456 for the Unix epoch; digits are
+// clamped to the range from 0 to 9. It is computed from the nanoseconds elapsed, for no precision to be lost however
+// far the origin is.
+func WithSeconds(digits int) Option {
+	return func(tsw *TimestampedWriter) {
+		tsw.seconds = true
+		tsw.secondsDigits = clampDigits(digits)
+	}
+}
+
+// WithDual makes timestamps in the absolute formats show the time elapsed since start as well, in a column of its own
+// after the time proper: 2024/01/02 15:04:05     +12.345s. It has no effect with the other modes.
+func WithDual() Option {
+	return func(tsw *TimestampedWriter) {
+		tsw.dual = true
+	}
+}
+
+// WithSecondZone makes timestamps in the time layouts show the time in location as well, in the same layout, after
+// the time proper: 2024/01/02 15:04:05 2024/01/02 14:04:05, e.g. for the local time followed by UTC. It has no effect
+// with the other formats and modes.
+func WithSecondZone(location *time.Location) Option {
+	return func(tsw *TimestampedWriter) {
+		tsw.secondZone = location
+	}
+}
+
+// WithColor makes the writer colorize timestamps with the ANSI SGR sequence sgr (e.g. "\x1b[31m" for red), rather
+// than dim them, when colors are enabled. Those of slow lines are red regardless.
+func WithColor(sgr string) Option {
+	return func(tsw *TimestampedWriter) {
+		tsw.sgr = sgr
+	}
+}
+
+// WithPassThrough makes the writer output lines as they are, without timestamps nor any other change of the encoding,
+// while still keeping them whole with respect to other writers sharing the mutex.
+func WithPassThrough() Option {
+	return func(tsw *TimestampedWriter) {
+		tsw.passThrough = true
+	}
+}
+
+// WithRaw makes the writer copy the data written to it through untouched, as for binary data: it is not split into
+// lines, nor timestamped, nor transformed in any other way. WriteLine is not to be used in this mode.
+func WithRaw() Option {
+	return func(tsw *TimestampedWriter) {
+		tsw.raw = true
+	}
+}
+
+// WithLineBuffering makes WriteLine flush the underlying writer after each line, as Write does, for the lines to show
+// as soon as possible rather than batched.
+func WithLineBuffering() Option {
+	return func(tsw *TimestampedWriter) {
+		tsw.lineBuffered = true
+	}
+}
+
+// WithQuote makes the writer output messages as double-quoted strings, with Go escapes for quotes, backslashes and
+// anything not printable, as in "say \"hi\"", so that whatever they contain cannot be taken for the separator or a line
+// ending; timestamps are left as they are. It applies to the TEXT encoding, where the flush interval no longer applies.
+func WithQuote() Option {
+	return func(tsw *TimestampedWriter) {
+		tsw.quote = true
+	}
+}
+
+// WithMatch limits timestamps to the lines matching re, with the TEXT encoding: the others are output as they are,
+// and do not count as lines for the delta mode and Stats. Partial lines output after the flush interval are always
+// timestamped, there being no telling whether they match yet.
+func WithMatch(re *regexp.Regexp) Option {
+	return func(tsw *TimestampedWriter) {
+		tsw.match = re
+	}
+}
+
+// WithGrep limits the output to the lines matching re, or with invert to those not matching it; the others are dropped
+// altogether, and do not count as lines for the delta mode and Stats: deltas are between lines output. As there is no
+// telling whether a partial line matches, the flush interval no longer applies.
+func WithGrep(re *regexp.Regexp, invert bool) Option {
+	return func(tsw *TimestampedWriter) {
+		tsw.grep = re
+		tsw.grepInvert = invert
+	}
+}
+
+// WithBlankLines makes the writer output blank lines, those empty or made of white space only, as they are without a
+// timestamp, or drop them altogether if skip is set. Either way they do not count as lines for the delta mode and
+// Stats. Not timestamping them applies to the TEXT encoding only.
+func WithBlankLines(skip bool) Option {
+	return func(tsw *TimestampedWriter) {
+		tsw.bareBlank = !skip
+		tsw.skipBlank = skip
+	}
+}
+
+// WithDedup collapses runs of identical consecutive lines into a single one, timestamped with the time of the first of
+// them and followed by their count, as in "retrying (x12)". Lines are therefore held back until a different one comes,
+// or until Close; as with WithGrep, the flush interval no longer applies.
+func WithDedup() Option {
+	return func(tsw *TimestampedWriter) {
+		tsw.dedup = true
+	}
+}
+
+// WithSequence numbers the lines before their timestamps, as in 000123, zero-padded to width digits, with the TEXT
+// encoding. Writers given the same counter share the numbering, in the order their lines are output.
+func WithSequence(counter *atomic.Int64, width int) Option {
+	return func(tsw *TimestampedWriter) {
+		tsw.sequence = counter
+		tsw.seqWidth = width
+	}
+}
+
+// WithFields makes the records of the JSON and LOGFMT encodings made of fields, in that order and by those keys,
+// rather than the usual ones; fields left out are not output at all. Keys are to be fit for logfmt, with no spaces,
+// quotes nor equal signs.
+func WithFields(fields ...Field) Option {
+	return func(tsw *TimestampedWriter) {
+		tsw.fields = fields
+	}
+}
+
+// WithJSONArray makes the records of the JSON encoding the elements of a single JSON array, rather than documents of
+// their own: each of them is preceded by a comma but for the first, and by a line ending, for the caller to open the
+// array with JSONArrayOpening and close it with JSONArrayClosing. Writers given the same flag share the array, in the
+// order their lines are output. Until the array is closed, the output is not valid JSON.
+func WithJSONArray(started *atomic.Bool) Option {
+	return func(tsw *TimestampedWriter) {
+		tsw.jsonArray = started
+	}
+}
+
+// WithWidth pads timestamps with spaces to width characters, after them or, with alignRight, before them, so that
+// separators line up whatever the length of the timestamps. Longer timestamps are left as they are.
+func WithWidth(width int, alignRight bool) Option {
+	return func(tsw *TimestampedWriter) {
+		tsw.width = width
+		tsw.alignRight = alignRight
+	}
+}
+
+// Write outputs the complete lines in p, each prepended with a timestamp: the time of the call, which is the time the
+// lines were read for callers writing them as soon as they are. The lines go out in a single write to the underlying
+// writer, which is flushed as Flush does. The trailing partial line, if any, is held back until the rest of it is
+// written, or until Close.
+func (tsw *TimestampedWriter) Write(p []byte) (int, error) {
+	tsw.mu.Lock()
+	defer tsw.mu.Unlock()
+
+	if tsw.err != nil {
+		return 0, tsw.err
+	}
+	if tsw.timer != nil {
+		tsw.timer.Stop()
+	}
+	if tsw.raw {
+		tsw.pending.Write(p)
+		err := tsw.commit()
+		if err == nil {
+			err = tsw.flush()
+		}
+		if err != nil {
+			return 0, err
+		}
+		return len(p), nil
+	}
+
+	/* the lines in p arrived together, as far as can be told */
+	now := tsw.now()
+	rest := p
+	for first := true; ; first = false {
+		if tsw.afterCR && 0 < len(rest) {
+			/* a \r\n pair is a single line ending */
+			if rest[0] == '\n' {
+				rest = rest[1:]
+			}
+			tsw.afterCR = false
+		}
+
+		i := tsw.lineEnd(rest)
+		if i < 0 {
+			break
+		}
+		line := rest[:i]
+		tsw.afterCR = rest[i] == '\r'
+		rest = rest[i+1:]
+
+		/* the first complete line finishes off whatever fragment was left over by the previous call */
+		if first && 0 < len(tsw.incomplete) {
+			line = append(tsw.incomplete, line...)
+			tsw.incomplete = tsw.incomplete[:0]
+		}
+
+		if first && tsw.open {
+			/* the beginning of this line has already been flushed, timestamp included */
+			tsw.writeRaw(tsw.trimCR(line), tsw.terminator)
+			tsw.open = false
+		} else {
+			tsw.writeLine(now, line)
+		}
+	}
+
+	/* stash the trailing fragment, copying it as p belongs to the caller */
+	tsw.incomplete = append(tsw.incomplete, rest...)
+
+	err := tsw.commit()
+	if err == nil {
+		err = tsw.flush()
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	if 0 < tsw.flushInterval && 0 < len(tsw.incomplete) {
+		if tsw.timer == nil {
+			tsw.timer = time.AfterFunc(tsw.flushInterval, tsw.flushIncomplete)
+		} else {
+			tsw.timer.Reset(tsw.flushInterval)
+		}
+	}
+
+	return len(p), nil
+}
+
+// lineEnd returns the index of the first line ending in p, or -1 if there is none.
+func (tsw *TimestampedWriter) lineEnd(p []byte) int {
+	if tsw.cr && tsw.delimiter == '\n' {
+		return bytes.IndexAny(p, "\r\n")
+	}
+
+	return bytes.IndexByte(p, tsw.delimiter)
+}
+
+// WriteLine outputs line, a complete line without its newline, prepended with a timestamp for the time t it was read
+// at; t being taken as close as possible to the arrival of the data, lines are not stamped late when output lags
+// behind. It is meant for callers splitting text into lines on their own, and has nothing to do with the partial line
+// bookkeeping of Write: the two are not to be mixed. The underlying writer is not flushed, for a buffered one to batch
+// lines coming in bursts: that is up to the caller, by way of Flush; unless the writer is line buffered. As with the
+// origin of the elapsed times, t is to carry a monotonic clock reading for the elapsed times not to jump with the wall
+// clock.
+func (tsw *TimestampedWriter) WriteLine(t time.Time, line []byte) error {
+	tsw.mu.Lock()
+	defer tsw.mu.Unlock()
+
+	if tsw.err != nil {
+		return tsw.err
+	}
+
+	tsw.writeLine(t, line)
+	err := tsw.commit()
+	if err == nil && tsw.lineBuffered {
+		err = tsw.flush()
+	}
+	return err
+}
+
+// Close outputs the fragment left over after the last newline, if any, as a final timestamped line, and flushes the
+// underlying writer as Flush does: "a\nb" gives a line for b, while "a\n" ends on a line ending and gives no further
+// line, empty or otherwise. A fragment already output after the flush interval gets its terminator only. It does not
+// close the underlying writer.
+func (tsw *TimestampedWriter) Close() error {
+	tsw.mu.Lock()
+	defer tsw.mu.Unlock()
+
+	if tsw.timer != nil {
+		tsw.timer.Stop()
+	}
+	if tsw.err != nil {
+		return tsw.err
+	}
+
+	if tsw.open {
+		/* the line was started already, whatever came after it is to be finished off, even if nothing */
+		tsw.writeRaw(tsw.trimCR(tsw.incomplete), tsw.terminator)
+		tsw.open = false
+	} else if 0 < len(tsw.incomplete) {
+		tsw.writeLine(tsw.now(), tsw.incomplete)
+	}
+	tsw.incomplete = tsw.incomplete[:0]
+	tsw.writeRepeated()
+
+	err := tsw.commit()
+	if err != nil {
+		return err
+	}
+
+	return tsw.flush()
+}
+
+// Stats returns the number of lines output so far, and the longest time elapsed between two consecutive ones.
+func (tsw *TimestampedWriter) Stats() (int, time.Duration) {
+	tsw.mu.Lock()
+	defer tsw.mu.Unlock()
+
+	return tsw.lines, tsw.maxGap
+}
+
+// flusher is implemented by buffered writers, such as bufio.Writer.
+type flusher interface {
+	Flush() error
+}
+
+// bufferedWriter is implemented by buffered writers telling how much room is left in their buffer, such as
+// bufio.Writer.
+type bufferedWriter interface {
+	flusher
+	Available() int
+}
+
+// Flush commits the lines output so far, by calling the Flush method of the underlying writer if it has one; it is a
+// no-op otherwise. A partial line is still held back, as it only gets output once complete, or by Close.
+func (tsw *TimestampedWriter) Flush() error {
+	tsw.mu.Lock()
+	defer tsw.mu.Unlock()
+
+	if tsw.err != nil {
+		return tsw.err
+	}
+
+	return tsw.flush()
+}
+
+func (tsw *TimestampedWriter) flush() error {
+	if f, ok := tsw.writer.(flusher); ok {
+		return f.Flush()
+	}
+
+	return nil
+}
+
+// commit writes out the pending output in one go. A buffered underlying writer without room for all of it is flushed
+// first, so that lines are not split across writes to the destination, where writers sharing it would interleave.
+func (tsw *TimestampedWriter) commit() error {
+	defer tsw.pending.Reset()
+
+	if tsw.pending.Len() == 0 {
+		return nil
+	}
+	if bw, ok := tsw.writer.(bufferedWriter); ok && bw.Available() < tsw.pending.Len() {
+		err := bw.Flush()
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err := tsw.writer.Write(tsw.pending.Bytes())
+	return err
+}
+
+// flushIncomplete outputs the pending fragment without waiting for the newline ending it, which leaves the current
+// line open: the rest of it will follow without a timestamp of its own. It is run once no data has arrived for the
+// flush interval.
+func (tsw *TimestampedWriter) flushIncomplete() {
+	tsw.mu.Lock()
+	defer tsw.mu.Unlock()
+
+	if len(tsw.incomplete) == 0 || tsw.err != nil {
+		return
+	}
+
+	if !tsw.open && !tsw.passThrough {
+		tsw.writeStamp(tsw.now())
+	}
+	tsw.writeRaw(tsw.incomplete)
+	tsw.incomplete = tsw.incomplete[:0]
+	tsw.open = true
+
+	err := tsw.commit()
+	if err == nil {
+		err = tsw.flush()
+	}
+
+	/* there is no caller to report to, the next Write or Close will */
+	tsw.err = err
+}
+
+// writeLine adds a single complete line to the pending output, prepending it with a timestamp.
+func (tsw *TimestampedWriter) writeLine(now time.Time, line []byte) {
+	if tsw.grep != nil && tsw.grep.Match(tsw.trimCR(line)) == tsw.grepInvert {
+		return
+	}
+	if tsw.passThrough {
+		tsw.writeRaw(line, tsw.terminator)
+		return
+	}
+
+	line = tsw.trimCR(line)
+	if tsw.skipBlank && isBlank(line) {
+		return
+	}
+	if tsw.dedup {
+		if 0 < tsw.repeats && bytes.Equal(line, tsw.repeated) {
+			tsw.repeats++
+			return
+		}
+
+		tsw.writeRepeated()
+		tsw.repeated = append(tsw.repeated[:0], line...)
+		tsw.repeatedAt, tsw.repeats = now, 1
+		return
+	}
+
+	tsw.renderLine(now, line)
+}
+
+// writeRepeated adds the line held back as per the dedup mode, if any, to the pending output, followed by its count
+// if it came more than once.
+func (tsw *TimestampedWriter) writeRepeated() {
+	if tsw.repeats == 0 {
+		return
+	}
+
+	line := tsw.repeated
+	if 1 < tsw.repeats {
+		line = fmt.Appendf(line, " (x%d)", tsw.repeats)
+	}
+	tsw.renderLine(tsw.repeatedAt, line)
+	tsw.repeated, tsw.repeats = line[:0], 0
+}
+
+// renderLine adds a single complete line, without its line ending, to the pending output as per the encoding.
+func (tsw *TimestampedWriter) renderLine(now time.Time, line []byte) {
+	switch tsw.encoding {
+	case JSON:
+		tsw.writeJSON(now, line)
+	case LOGFMT:
+		tsw.writeLogfmt(now, line)
+	case CSV:
+		tsw.writeCSV(now, line)
+	default:
+		if (tsw.match == nil || tsw.match.Match(line)) && !(tsw.bareBlank && isBlank(line)) {
+			tsw.writeStamp(now)
+		}
+		if tsw.quote {
+			line = strconv.AppendQuote(nil, string(line))
+		}
+		tsw.writeRaw(line, tsw.terminator)
+	}
+}
+
+// isBlank tells whether the line is empty or made of white space only.
+func isBlank(line []byte) bool {
+	return len(bytes.TrimSpace(line)) == 0
+}
+
+// trimCR drops the carriage return of a CRLF line ending, unless told to keep it.
+func (tsw *TimestampedWriter) trimCR(line []byte) []byte {
+	if tsw.keepCR || tsw.delimiter != '\n' {
+		return line
+	}
+
+	return bytes.TrimSuffix(line, []byte("\r"))
+}
+
+// writeJSON adds a single complete line to the pending output as a JSON object. The epoch formats give a number for
+// the timestamp, the others a string.
+func (tsw *TimestampedWriter) writeJSON(now time.Time, line []byte) {
+	timestamp, numeric, _ := tsw.timestamp(now)
+
+	/* no escaping of <, > and &: the output is not meant for HTML; strings cannot fail to encode */
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	buf.WriteByte('{')
+	for i, f := range tsw.recordFields(jsonFields) {
+		if 0 < i {
+			buf.WriteByte(',')
+		}
+		_ = enc.Encode(f.Key)
+		buf.Truncate(buf.Len() - 1)
+		buf.WriteByte(':')
+
+		value, isNumber := tsw.fieldValue(f.Kind, timestamp, line), f.Kind == TimeField && numeric
+		if isNumber {
+			buf.WriteString(value)
+		} else {
+			_ = enc.Encode(value)
+			buf.Truncate(buf.Len() - 1)
+		}
+	}
+	buf.WriteByte('}')
+
+	object := buf.Bytes()
+	switch {
+	case tsw.jsonArray == nil:
+		tsw.writeRaw(object, tsw.recordEnd())
+	case tsw.jsonArray.Swap(true):
+		tsw.writeRaw([]byte(","), tsw.recordEnd(), object)
+	default:
+		tsw.writeRaw(tsw.recordEnd(), object)
+	}
+}
+
+// writeLogfmt adds a single complete line to the pending output as logfmt key=value pairs.
+func (tsw *TimestampedWriter) writeLogfmt(now time.Time, line []byte) {
+	timestamp, _, _ := tsw.timestamp(now)
+
+	for i, f := range tsw.recordFields(logfmtFields) {
+		if 0 < i {
+			tsw.pending.WriteByte(' ')
+		}
+		_, _ = fmt.Fprintf(&tsw.pending, "%s=%s", f.Key, logfmtValue(tsw.fieldValue(f.Kind, timestamp, line)))
+	}
+	tsw.writeRaw(tsw.recordEnd())
+}
+
+// recordFields returns the fields of the records, those given to the writer if any, or else the usual ones.
+func (tsw *TimestampedWriter) recordFields(usual []Field) []Field {
+	if tsw.fields != nil {
+		return tsw.fields
+	}
+	return usual
+}
+
+// fieldValue returns the value of the field of the given kind, for a line with the timestamp.
+func (tsw *TimestampedWriter) fieldValue(kind FieldKind, timestamp string, line []byte) string {
+	switch kind {
+	case TimeField:
+		return timestamp
+	case StreamField:
+		return tsw.streamName
+	default:
+		return string(line)
+	}
+}
+
+// writeCSV adds a single complete line to the pending output as a CSV record, quoting the fields that need it.
+func (tsw *TimestampedWriter) writeCSV(now time.Time, line []byte) {
+	timestamp, _, _ := tsw.timestamp(now)
+
+	w := csv.NewWriter(&tsw.pending)
+	w.UseCRLF = string(tsw.recordEnd()) == "\r\n"
+	_ = w.Write([]string{timestamp, tsw.streamName, string(line)})
+	w.Flush()
+}
+
+// recordEnd returns what the records of the JSON, LOGFMT and CSV encodings end with: a CRLF if that is the
+// terminator, a newline otherwise.
+func (tsw *TimestampedWriter) recordEnd() []byte {
+	if bytes.Equal(tsw.terminator, []byte("\r\n")) {
+		return tsw.terminator
+	}
+	return []byte("\n")
+}
+
+// logfmtValue renders s as a logfmt value, quoting it if it is empty or contains spaces, quotes, equal signs or
+// anything that is not printable.
+func logfmtValue(s string) string {
+	if s == "" || strings.ContainsAny(s, " \"=\\") || strings.IndexFunc(s, func(r rune) bool {
+		return !unicode.IsPrint(r)
+	}) != -1 {
+		return strconv.Quote(s)
+	}
+
+	return s
+}
+
+// writeStamp adds the prefix, the timestamp and the separator opening a line to the pending output.
+func (tsw *TimestampedWriter) writeStamp(now time.Time) {
+	tsw.pending.WriteString(tsw.prefix)
+	if tsw.sequence != nil {
+		_, _ = fmt.Fprintf(&tsw.pending, "%0*d ", tsw.seqWidth, tsw.sequence.Add(1))
+	}
+
+	timestamp, _, gap := tsw.timestamp(now)
+	slow := 0 < tsw.slow && tsw.slow < gap
+	if slow && !tsw.color {
+		timestamp += "!"
+	}
+	if padding := tsw.width - utf8.RuneCountInString(timestamp); 0 < padding && tsw.alignRight {
+		timestamp = strings.Repeat(" ", padding) + timestamp
+	} else if 0 < padding {
+		timestamp += strings.Repeat(" ", padding)
+	}
+	if tsw.color && slow {
+		timestamp = sgrRed + timestamp + sgrReset
+	} else if tsw.color {
+		timestamp = tsw.sgr + timestamp + sgrReset
+	}
+	tsw.pending.WriteString(timestamp)
+	tsw.pending.WriteString(tsw.separator)
+
+	if tag, ok := streamLabels[tsw.streamName]; ok && tsw.label {
+		_, _ = fmt.Fprintf(&tsw.pending, "[%s] ", tag)
+	}
+}
+
+// timestamp renders the timestamp of a line read at now, and tells whether it is a plain number, as with the epoch
+// formats, along with the time elapsed since the previous line (zero for the first one).
+func (tsw *TimestampedWriter) timestamp(now time.Time) (string, bool, time.Duration) {
+	var (
+		timestamp string
+		numeric   bool
+		gap       time.Duration
+	)
+
+	if !tsw.last.IsZero() {
+		gap = elapsedSince(tsw.last, now)
+	}
+	tsw.last = now
+	tsw.lines++
+	if tsw.maxGap < gap {
+		tsw.maxGap = gap
+	}
+
+	switch {
+	case tsw.seconds && !tsw.base.IsZero():
+		timestamp = tsw.sinceStart(formatSeconds(now.Sub(tsw.base), tsw.secondsDigits), 12)
+	case tsw.seconds:
+		timestamp = tsw.sinceStart(formatSeconds(elapsedSince(tsw.start, now), tsw.secondsDigits), 12)
+	case !tsw.base.IsZero():
+		timestamp = fmt.Sprintf("%+12.3fs", now.Sub(tsw.base).Seconds())
+	case tsw.millis && tsw.unit == time.Nanosecond:
+		timestamp = tsw.sinceStart(strconv.FormatInt(elapsedSince(tsw.start, now).Nanoseconds(), 10), 15) + "ns"
+	case tsw.millis && tsw.unit == time.Microsecond:
+		us := float64(elapsedSince(tsw.start, now).Nanoseconds()) / 1e3
+		timestamp = tsw.sinceStart(strconv.FormatFloat(us, 'f', tsw.precision, 64), 15) + "us"
+	case tsw.millis:
+		ms := float64(elapsedSince(tsw.start, now).Nanoseconds()) / 1e6
+		timestamp = tsw.sinceStart(strconv.FormatFloat(ms, 'f', tsw.precision, 64), 12) + "ms"
+	case tsw.elapsed && tsw.human:
+		timestamp = formatHuman(elapsedSince(tsw.start, now))
+	case tsw.elapsed:
+		timestamp = formatElapsed(elapsedSince(tsw.start, now))
+	case tsw.delta:
+		timestamp = formatElapsed(gap)
+	case tsw.timeFormat == UNIX:
+		timestamp, numeric = strconv.FormatInt(now.Unix(), 10), true
+	case tsw.timeFormat == UNIXMILLI:
+		timestamp, numeric = strconv.FormatInt(now.UnixMilli(), 10), true
+	case tsw.timeFormat == UNIXNANO:
+		timestamp, numeric = strconv.FormatInt(now.UnixNano(), 10), true
+	default:
+		timestamp = tsw.formatTime(now, tsw.location)
+		if tsw.secondZone != nil {
+			timestamp += " " + tsw.formatTime(now, tsw.secondZone)
+		}
+	}
+	if tsw.dual && tsw.base.IsZero() && !tsw.millis && !tsw.elapsed && !tsw.delta {
+		timestamp, numeric = timestamp+fmt.Sprintf(" %+11.3fs", elapsedSince(tsw.start, now).Seconds()), false
+	}
+
+	return timestamp, numeric, gap
+}
+
+// elapsedSince returns the time elapsed from t to now. Given monotonic clock readings, as time.Now gives, it is
+// measured by the monotonic clock, and thus unaffected by the wall clock being set or stepped meanwhile; it is never
+// negative, times coming out of order counting as no time elapsed at all.
+func elapsedSince(t time.Time, now time.Time) time.Duration {
+	d := now.Sub(t)
+	if d < 0 {
+		return 0
+	}
+	return d
+}
+
+// formatTime renders t in the layout of the writer, in location if not nil, followed by the fraction of a second if
+// enabled.
+func (tsw *TimestampedWriter) formatTime(t time.Time, location *time.Location) string {
+	if location != nil {
+		t = t.In(location)
+	}
+
+	if tsw.timeFormat == ISOWeek {
+		return ISOWeekDate(t)
+	}
+	s := t.Format(tsw.format)
+	if tsw.timeFormat == ISOWeekTime {
+		s = ISOWeekDate(t) + s
+	}
+	if 0 < tsw.fraction {
+		s += "." + fmt.Sprintf("%09d", t.Nanosecond())[:tsw.fraction]
+	}
+	return s
+}
+
+// sinceStart pads the time since start of the millis mode to the width of its column, the default width of the unit
+// unless set otherwise, or that of the widest time so far if wider yet.
+func (tsw *TimestampedWriter) sinceStart(value string, defaultWidth int) string {
+	width := defaultWidth
+	if 0 <= tsw.numWidth {
+		width = tsw.numWidth
+	}
+	if width < len(value) {
+		tsw.numWidth = len(value)
+		width = len(value)
+	}
+
+	return strings.Repeat(" ", width-len(value)) + value
+}
+
+// ANSI SGR sequences used to colorize timestamps.
+const (
+	sgrDim   = "\x1b[2m"
+	sgrRed   = "\x1b[31m"
+	sgrReset = "\x1b[0m"
+)
+
+// streamLabels are the tags identifying the child's streams, all of the same width so that text stays aligned.
+var streamLabels = map[string]string{
+	"stdout": "out",
+	"stderr": "err",
+}
+
+// writeRaw adds chunks to the pending output as they are.
+func (tsw *TimestampedWriter) writeRaw(chunks ...[]byte) {
+	for _, chunk := range chunks {
+		tsw.pending.Write(chunk)
+	}
+}
+
+// formatElapsed renders d as HH:MM:SS.mmm.
+func formatElapsed(d time.Duration) string {
+	ms := d.Milliseconds()
+	return fmt.Sprintf("%02d:%02d:%02d.%03d", ms/3600000, ms/60000%60, ms/1000%60, ms%1000)
+}
+
+// formatSeconds renders d in seconds, with a sign and digits decimals, as in +12.345678; by integer arithmetic, for
+// durations of decades to keep all of the digits.
+func formatSeconds(d time.Duration, digits int) string {
+	sign := "+"
+	if d < 0 {
+		sign, d = "-", -d
+	}
+
+	s := sign + strconv.FormatInt(int64(d/time.Second), 10)
+	if 0 < digits {
+		s += "." + fmt.Sprintf("%09d", int64(d%time.Second))[:digits]
+	}
+	return s
+}
+
+// formatHuman renders d in units depending on how long it is, as 12.345s, 2m03s, 1h02m03s or 2d03h04m, padded to the
+// width of the longest of them.
+func formatHuman(d time.Duration) string {
+	s := int64(d / time.Second)
+	switch {
+	case d < time.Minute:
+		return fmt.Sprintf("%9.3fs", d.Seconds())
+	case d < time.Hour:
+		return fmt.Sprintf("%6dm%02ds", s/60, s%60)
+	case d < 24*time.Hour:
+		return fmt.Sprintf("%3dh%02dm%02ds", s/3600, s/60%60, s%60)
+	default:
+		return fmt.Sprintf("%3dd%02dh%02dm", s/86400, s/3600%24, s/60%60)
+	}
+}
@@ -0,0 +1,449 @@
+package timestamps
+
+import (
+	"bytes"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fixedTime is the time the writers under test are stamped with, unless the test needs the clock to move.
+var fixedTime = time.Date(2024, time.March, 5, 14, 7, 9, 123456789, time.UTC)
+
+// fixedClock returns a clock always reading t.
+func fixedClock(t time.Time) func() time.Time {
+	return func() time.Time { return t }
+}
+
+// newTestWriter creates a writer to buf stamped as per the fixed clock, in UTC.
+func newTestWriter(buf *bytes.Buffer, opts ...Option) *TimestampedWriter {
+	opts = append([]Option{WithClock(fixedClock(fixedTime)), WithLocation(time.UTC)}, opts...)
+	return NewTimestampedWriter(buf, "stdout", opts...)
+}
+
+func TestWritePartialLines(t *testing.T) {
+	tests := []struct {
+		name   string
+		writes []string
+		want   string
+	}{
+		{"partial line", []string{"ab"}, "2024/03/05 02:07:09| ab\n"},
+		{"line completed by a later write", []string{"ab", "c\nd"}, "2024/03/05 02:07:09| abc\n2024/03/05 02:07:09| d\n"},
+		{"several lines in one write", []string{"e\nf\n"}, "2024/03/05 02:07:09| e\n2024/03/05 02:07:09| f\n"},
+		{"fragments across writes", []string{"ab", "c\nd", "e\nf\n", "g"},
+			"2024/03/05 02:07:09| abc\n2024/03/05 02:07:09| de\n2024/03/05 02:07:09| f\n2024/03/05 02:07:09| g\n"},
+		{"empty lines", []string{"\n", "\n"}, "2024/03/05 02:07:09| \n2024/03/05 02:07:09| \n"},
+		{"nothing", nil, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			w := newTestWriter(&buf)
+			for _, s := range tt.writes {
+				n, err := w.Write([]byte(s))
+				if err != nil || n != len(s) {
+					t.Fatalf("Write(%q) = %d, %v; want %d, nil", s, n, err, len(s))
+				}
+			}
+			if err := w.Close(); err != nil {
+				t.Fatalf("Close() = %v", err)
+			}
+
+			if got := buf.String(); got != tt.want {
+				t.Errorf("output = %q; want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWriteHoldsBackPartialLine(t *testing.T) {
+	var buf bytes.Buffer
+	w := newTestWriter(&buf)
+
+	_, _ = w.Write([]byte("a\nb"))
+	if got, want := buf.String(), "2024/03/05 02:07:09| a\n"; got != want {
+		t.Errorf("output before Close = %q; want %q", got, want)
+	}
+}
+
+// steppingClock returns a clock reading each of times in turn, and the last one from then on.
+func steppingClock(times ...time.Time) func() time.Time {
+	i := 0
+	return func() time.Time {
+		t := times[i]
+		if i < len(times)-1 {
+			i++
+		}
+		return t
+	}
+}
+
+func TestWithClock(t *testing.T) {
+	tests := []struct {
+		name string
+		opts []Option
+		want string
+	}{
+		{"absolute time", nil, "2024/03/05 02:07:10| a\n2024/03/05 02:08:11| b\n"},
+		{"milliseconds since start", []Option{WithSinceStart(time.Millisecond)},
+			"    1500.000ms| a\n   62005.000ms| b\n"},
+		{"elapsed time", []Option{WithElapsed()}, "00:00:01.500| a\n00:01:02.005| b\n"},
+		{"delta time", []Option{WithDelta()}, "00:00:00.000| a\n00:01:00.505| b\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			/* the first reading, at the creation of the writer, is the origin of the elapsed times */
+			clock := steppingClock(fixedTime, fixedTime.Add(1500*time.Millisecond),
+				fixedTime.Add(62*time.Second+5*time.Millisecond))
+			opts := append([]Option{WithClock(clock), WithLocation(time.UTC)}, tt.opts...)
+
+			var buf bytes.Buffer
+			w := NewTimestampedWriter(&buf, "stdout", opts...)
+			_, _ = w.Write([]byte("a\n"))
+			_, _ = w.Write([]byte("b\n"))
+			_ = w.Close()
+
+			if got := buf.String(); got != tt.want {
+				t.Errorf("output = %q; want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+// benchmarkLines is the input of the benchmarks, a batch of lines as read in one go.
+var benchmarkLines = bytes.Repeat([]byte("2024-03-05 14:07:09 INFO handled request in 12ms\n"), 100)
+
+func BenchmarkWrite(b *testing.B) {
+	w := NewTimestampedWriter(io.Discard, "stdout")
+	b.SetBytes(int64(len(benchmarkLines)))
+	for i := 0; i < b.N; i++ {
+		_, _ = w.Write(benchmarkLines)
+	}
+}
+
+func BenchmarkWriteLine(b *testing.B) {
+	w := NewTimestampedWriter(io.Discard, "stdout")
+	lines := bytes.SplitAfter(benchmarkLines, []byte("\n"))
+	b.SetBytes(int64(len(benchmarkLines)))
+	for i := 0; i < b.N; i++ {
+		now := time.Now()
+		for _, line := range lines[:len(lines)-1] {
+			_ = w.WriteLine(now, line[:len(line)-1])
+		}
+	}
+}
+
+func TestWithPrecision(t *testing.T) {
+	tests := []struct {
+		digits int
+		want   string
+	}{
+		{0, "2024/03/05 02:07:09| a\n"},
+		{3, "2024/03/05 02:07:09.123| a\n"},
+		{9, "2024/03/05 02:07:09.123456789| a\n"},
+		{12, "2024/03/05 02:07:09.123456789| a\n"},
+		{-1, "2024/03/05 02:07:09| a\n"},
+	}
+
+	for _, tt := range tests {
+		var buf bytes.Buffer
+		w := newTestWriter(&buf, WithPrecision(tt.digits))
+		_, _ = w.Write([]byte("a\n"))
+
+		if got := buf.String(); got != tt.want {
+			t.Errorf("WithPrecision(%d) output = %q; want %q", tt.digits, got, tt.want)
+		}
+	}
+}
+
+func TestWithSeconds(t *testing.T) {
+	tests := []struct {
+		digits int
+		want   string
+	}{
+		{0, "          +1| a\n"},
+		{3, "      +1.500| a\n"},
+		{9, "+1.500000250| a\n"},
+		{12, "+1.500000250| a\n"},
+		{-1, "          +1| a\n"},
+	}
+
+	for _, tt := range tests {
+		var buf bytes.Buffer
+		clock := steppingClock(fixedTime, fixedTime.Add(1500*time.Millisecond+250))
+		w := NewTimestampedWriter(&buf, "stdout", WithClock(clock), WithSeconds(tt.digits))
+		_, _ = w.Write([]byte("a\n"))
+
+		if got := buf.String(); got != tt.want {
+			t.Errorf("WithSeconds(%d) output = %q; want %q", tt.digits, got, tt.want)
+		}
+	}
+}
+
+func TestClose(t *testing.T) {
+	tests := []struct {
+		name  string
+		write string
+		want  string
+	}{
+		{"ending on a line ending", "a\n", "2024/03/05 02:07:09| a\n"},
+		{"ending mid-line", "a\nb", "2024/03/05 02:07:09| a\n2024/03/05 02:07:09| b\n"},
+		{"ending on an empty line", "a\n\n", "2024/03/05 02:07:09| a\n2024/03/05 02:07:09| \n"},
+		{"nothing written", "", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			w := newTestWriter(&buf)
+			_, _ = w.Write([]byte(tt.write))
+			if err := w.Close(); err != nil {
+				t.Fatalf("Close() = %v", err)
+			}
+
+			if got := buf.String(); got != tt.want {
+				t.Errorf("output = %q; want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSharedMutex(t *testing.T) {
+	/* run with -race: writers of several streams sharing a destination, written to concurrently */
+	const lines = 1000
+	var (
+		buf bytes.Buffer
+		mu  sync.Mutex
+		wg  sync.WaitGroup
+	)
+	for _, name := range []string{"out", "err"} {
+		w := newTestWriter(&buf, WithMutex(&mu))
+		wg.Add(1)
+		go func(name string) {
+			defer wg.Done()
+			for i := 0; i < lines; i++ {
+				/* in pieces, for lines to be put together across writes */
+				_, _ = w.Write([]byte(name + "-"))
+				_, _ = w.Write([]byte(strconv.Itoa(i) + "\n"))
+			}
+			_ = w.Close()
+		}(name)
+	}
+	wg.Wait()
+
+	counts := make(map[string]int)
+	intact := regexp.MustCompile(`^2024/03/05 02:07:09\| (out|err)-[0-9]+$`)
+	for _, line := range strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n") {
+		m := intact.FindStringSubmatch(line)
+		if m == nil {
+			t.Fatalf("interleaved line %q", line)
+		}
+		counts[m[1]]++
+	}
+	if counts["out"] != lines || counts["err"] != lines {
+		t.Errorf("lines = %v; want %d of each", counts, lines)
+	}
+}
+
+func TestWritersWithOppositeSettings(t *testing.T) {
+	/* the settings are those of each writer, not shared through globals */
+	tf := RFC3339
+	var a, b bytes.Buffer
+	wa := NewTimestampedWriter(&a, "stderr", WithClock(fixedClock(fixedTime)), WithLocation(time.UTC), WithLabel(),
+		WithColors(), WithPrefix("[x] "))
+	wb := NewTimestampedWriter(&b, "stdout", WithClock(fixedClock(fixedTime)),
+		WithLocation(time.FixedZone("CET", 3600)), WithFormat(tf, tf.String()), WithSeparator("\t"))
+	_, _ = wa.Write([]byte("a\n"))
+	_, _ = wb.Write([]byte("b\n"))
+
+	if got, want := a.String(), "[x] \x1b[2m2024/03/05 02:07:09\x1b[0m| [err] a\n"; got != want {
+		t.Errorf("first writer output = %q; want %q", got, want)
+	}
+	if got, want := b.String(), "2024-03-05T15:07:09+01:00\tb\n"; got != want {
+		t.Errorf("second writer output = %q; want %q", got, want)
+	}
+}
+
+func TestWithCR(t *testing.T) {
+	tests := []struct {
+		name   string
+		writes []string
+		want   string
+	}{
+		{"progress bar", []string{"10%\r20%\r100%\n"},
+			"2024/03/05 02:07:09| 10%\n2024/03/05 02:07:09| 20%\n2024/03/05 02:07:09| 100%\n"},
+		{"CRLF as a single line ending", []string{"a\r\nb\r\n"}, "2024/03/05 02:07:09| a\n2024/03/05 02:07:09| b\n"},
+		{"CRLF split across writes", []string{"a\r", "\nb\n"}, "2024/03/05 02:07:09| a\n2024/03/05 02:07:09| b\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			w := newTestWriter(&buf, WithCR())
+			for _, s := range tt.writes {
+				_, _ = w.Write([]byte(s))
+			}
+			_ = w.Close()
+
+			if got := buf.String(); got != tt.want {
+				t.Errorf("output = %q; want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCRLF(t *testing.T) {
+	tests := []struct {
+		name string
+		opts []Option
+		want string
+	}{
+		{"carriage returns dropped", nil, "2024/03/05 02:07:09| a\n2024/03/05 02:07:09| b\n"},
+		{"carriage returns kept", []Option{WithKeepCR()}, "2024/03/05 02:07:09| a\r\n2024/03/05 02:07:09| b\r\n"},
+		{"CRLF terminators", []Option{WithDelimiters('\n', "\r\n")},
+			"2024/03/05 02:07:09| a\r\n2024/03/05 02:07:09| b\r\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			w := newTestWriter(&buf, tt.opts...)
+			_, _ = w.Write([]byte("a\r\nb\r\n"))
+			_ = w.Close()
+
+			if got := buf.String(); got != tt.want {
+				t.Errorf("output = %q; want %q", got, tt.want)
+			}
+		})
+	}
+
+	/* as with lines split by Copy, handed over to WriteLine */
+	lines := copyLines(t, "a\r\nb\r\n")
+	if len(lines) != 2 || lines[0] != "a\n" || lines[1] != "b\n" {
+		t.Errorf("copied lines = %q; want no carriage returns", lines)
+	}
+}
+
+func TestNULDelimited(t *testing.T) {
+	tests := []struct {
+		name       string
+		terminator string
+		want       string
+	}{
+		{"NUL terminators", "\x00", "2024/03/05 02:07:09| a\nb\r\x002024/03/05 02:07:09| c\x00"},
+		{"newline terminators", "\n", "2024/03/05 02:07:09| a\nb\r\n2024/03/05 02:07:09| c\n"},
+	}
+
+	/* newlines and carriage returns are part of the records, rather than ending them */
+	const input = "a\nb\r\x00c\x00"
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			w := newTestWriter(&buf, WithDelimiters(0, tt.terminator), WithCR())
+			_, _ = w.Write([]byte(input))
+			_ = w.Close()
+			if got := buf.String(); got != tt.want {
+				t.Errorf("written output = %q; want %q", got, tt.want)
+			}
+
+			buf.Reset()
+			w = newTestWriter(&buf, WithDelimiters(0, tt.terminator))
+			_ = w.Copy(strings.NewReader(input))
+			_ = w.Close()
+			if got := buf.String(); got != tt.want {
+				t.Errorf("copied output = %q; want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSinceStartUnits(t *testing.T) {
+	tests := []struct {
+		name string
+		opts []Option
+		want string
+	}{
+		{"microseconds", []Option{WithSinceStart(time.Microsecond)},
+			"       1500.007us| a\n    2000000.003us| b\n"},
+		{"microseconds without decimals", []Option{WithSinceStart(time.Microsecond), WithMillisWidth(-1, 0)},
+			"           1500us| a\n        2000000us| b\n"},
+		{"nanoseconds", []Option{WithSinceStart(time.Nanosecond)}, "        1500007ns| a\n     2000000003ns| b\n"},
+		{"milliseconds", []Option{WithSinceStart(time.Millisecond)}, "       1.500ms| a\n    2000.000ms| b\n"},
+	}
+
+	/* the times are right-aligned in a column of fixed width, for the separators to line up */
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			clock := steppingClock(fixedTime, fixedTime.Add(1500*time.Microsecond+7), fixedTime.Add(2*time.Second+3))
+			w := NewTimestampedWriter(&buf, "stdout", append([]Option{WithClock(clock)}, tt.opts...)...)
+			_, _ = w.Write([]byte("a\n"))
+			_, _ = w.Write([]byte("b\n"))
+			_ = w.Close()
+
+			if got := buf.String(); got != tt.want {
+				t.Errorf("output = %q; want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMillisExtremes(t *testing.T) {
+	tests := []struct {
+		name string
+		opts []Option
+		want string
+	}{
+		{"default width", nil, "       0.000ms| a\n34560000000.000ms| b\n34560000001.000ms| c\n"},
+		{"narrow column", []Option{WithMillisWidth(6, 1)}, "   0.0ms| a\n34560000000.0ms| b\n34560000001.0ms| c\n"},
+	}
+
+	/* a nanosecond in, then 400 days: a time too wide for the column widens it, for the lines after it as well */
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			clock := steppingClock(fixedTime, fixedTime.Add(1), fixedTime.Add(400*24*time.Hour),
+				fixedTime.Add(400*24*time.Hour+time.Millisecond))
+			opts := append([]Option{WithClock(clock), WithSinceStart(time.Millisecond)}, tt.opts...)
+			w := NewTimestampedWriter(&buf, "stdout", opts...)
+			for _, line := range []string{"a\n", "b\n", "c\n"} {
+				_, _ = w.Write([]byte(line))
+			}
+			_ = w.Close()
+
+			if got := buf.String(); got != tt.want {
+				t.Errorf("output = %q; want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWithQuote(t *testing.T) {
+	tests := []struct {
+		line string
+		want string
+	}{
+		{`say "hi"`, `"say \"hi\""`},
+		{`C:\dir\file`, `"C:\\dir\\file"`},
+		{"a| b\ttab\x01", `"a| b\ttab\x01"`},
+		{"", `""`},
+		{"naïve 日本", `"naïve 日本"`},
+	}
+
+	/* the separator within a message cannot be told from that after the timestamp, unless quoted */
+	for _, tt := range tests {
+		var buf bytes.Buffer
+		w := newTestWriter(&buf, WithQuote())
+		_, _ = w.Write([]byte(tt.line + "\n"))
+
+		if got, want := buf.String(), "2024/03/05 02:07:09| "+tt.want+"\n"; got != want {
+			t.Errorf("quoted %q = %q; want %q", tt.line, got, want)
+		}
+	}
+}